@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// The actionsTrigger starts GitHub Actions workflows. With workflows
+// configured it dispatches them with the PR number as the "pr" input;
+// otherwise it re-runs the failed jobs of the runs for the PR head, or of
+// the runs of the named workflows only.
+type actionsTrigger struct {
+	url       string // GitHub API URL, or empty for the default
+	username  string
+	token     string
+	workflows []string
+}
+
+var errNoFailedRuns = errors.New("no failed workflow runs to re-run")
+
+func (t *actionsTrigger) apiURL() string {
+	if t.url != "" {
+		return t.url
+	}
+	return githubAPIURL
+}
+
+func (t *actionsTrigger) TriggerBuild(ctx context.Context, p pr, workflows []string) ([]triggeredBuild, error) {
+	if len(t.workflows) == 0 {
+		return nil, t.rerunFailed(ctx, p, workflows)
+	}
+	if len(workflows) == 0 {
+		workflows = t.workflows
+	}
+
+	var errs triggerErrors
+	for _, wf := range workflows {
+		errs = errs.add(wf, t.dispatch(ctx, p, wf))
+	}
+	return nil, errs.err()
+}
+
+func (t *actionsTrigger) dispatch(ctx context.Context, p pr, workflow string) error {
+	buf := new(bytes.Buffer)
+	json.NewEncoder(buf).Encode(map[string]interface{}{
+		"ref":    p.Base.Ref,
+		"inputs": map[string]string{"pr": fmt.Sprint(p.Number)},
+	})
+	u := fmt.Sprintf("%s/repos/%s/actions/workflows/%s/dispatches", t.apiURL(), p.repo(), url.PathEscape(workflow))
+	return githubRequest(ctx, "POST", u, buf, t.username, t.token)
+}
+
+type workflowRun struct {
+	ID         int64
+	Name       string
+	Status     string
+	Conclusion string
+}
+
+func (r workflowRun) failed() bool {
+	switch r.Conclusion {
+	case "failure", "cancelled", "timed_out":
+		return true
+	}
+	return false
+}
+
+func (t *actionsTrigger) rerunFailed(ctx context.Context, p pr, names []string) error {
+	var runs struct {
+		WorkflowRuns []workflowRun `json:"workflow_runs"`
+	}
+	u := fmt.Sprintf("%s/repos/%s/actions/runs?head_sha=%s", t.apiURL(), p.repo(), url.QueryEscape(p.Head.SHA))
+	if err := githubGet(ctx, u, t.username, t.token, &runs); err != nil {
+		return err
+	}
+
+	var errs triggerErrors
+	rerun := 0
+	for _, run := range runs.WorkflowRuns {
+		if !run.failed() || len(names) > 0 && !stringset(names).contains(run.Name) {
+			continue
+		}
+		u := fmt.Sprintf("%s/repos/%s/actions/runs/%d/rerun-failed-jobs", t.apiURL(), p.repo(), run.ID)
+		errs = errs.add(run.Name, githubRequest(ctx, "POST", u, new(bytes.Buffer), t.username, t.token))
+		rerun++
+	}
+	if rerun == 0 {
+		return errNoFailedRuns
+	}
+	return errs.err()
+}
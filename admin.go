@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The admin server provides an HTTP API for operators, on a listener of
+// its own. All requests must carry the admin token as a bearer token.
+type admin struct {
+	addr    string
+	token   string
+	db      *db
+	handler *handler
+
+	mut    sync.Mutex
+	server *http.Server
+}
+
+func newAdmin(addr, token string, db *db, h *handler) *admin {
+	return &admin{
+		addr:    addr,
+		token:   token,
+		db:      db,
+		handler: h,
+	}
+}
+
+func (a *admin) Serve() {
+	l, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		slog.Error("Listen", "error", err)
+		return
+	}
+
+	slog.Info("Admin API listening", "addr", l.Addr())
+	srv := &http.Server{Handler: a.mux()}
+	a.mut.Lock()
+	a.server = srv
+	a.mut.Unlock()
+	srv.Serve(l)
+}
+
+func (a *admin) Stop() {
+	a.mut.Lock()
+	srv := a.server
+	a.mut.Unlock()
+	if srv != nil {
+		srv.Shutdown(context.Background())
+	}
+}
+
+func (a *admin) mux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/audit", a.handleAudit)
+	mux.HandleFunc("/pending", a.handlePending)
+	mux.HandleFunc("/cancel", a.handleCancel)
+	mux.HandleFunc("/merge", a.handleMerge)
+	mux.HandleFunc("/recheck", a.handleRecheck)
+	mux.HandleFunc("/lgtm", a.handleLGTM)
+	mux.HandleFunc("/hold", a.handleHold)
+	mux.HandleFunc("/permissions/refresh", a.handleRefreshPermissions)
+	mux.HandleFunc("/reclone", a.handleReclone)
+	return a.authenticated(mux)
+}
+
+func (a *admin) authenticated(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAudit returns the audit log entries matching the repo, pr, user,
+// since and until query parameters. Times are in RFC 3339 format.
+func (a *admin) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "GET Expected", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var q auditQuery
+	var err error
+	params := r.URL.Query()
+	q.Repo = params.Get("repo")
+	q.Sender = params.Get("user")
+	if v := params.Get("pr"); v != "" {
+		if q.PR, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "pr: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries := a.db.AuditEntries(q)
+	if entries == nil {
+		entries = []auditEntry{}
+	}
+	writeJSON(w, entries)
+}
+
+// handlePending lists the pending merges.
+func (a *admin) handlePending(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "GET Expected", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.handler.pending.list())
+}
+
+// handleCancel cancels the pending merge of the given repo and pr.
+func (a *admin) handleCancel(w http.ResponseWriter, r *http.Request) {
+	repo, pr, ok := prParams(w, r, "POST")
+	if !ok {
+		return
+	}
+	if !a.handler.pending.cancelMerge(repo, pr) {
+		http.Error(w, "No merge pending", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, adminResult{"cancelled"})
+}
+
+// handleMerge merges the given repo and pr, as if the user (by default
+// the bot itself) had asked for it.
+func (a *admin) handleMerge(w http.ResponseWriter, r *http.Request) {
+	repo, pr, ok := prParams(w, r, "POST")
+	if !ok {
+		return
+	}
+
+	h := a.handler
+	c := a.comment(r, repo, pr, "merge")
+	ctx := withLogFields(context.Background(), "repo", repo, "pr", pr, "sender", c.Sender.Login, "command", "merge", "via", "admin")
+
+	h.mut.Lock()
+	err := h.merge(ctx, c, newAuditEntry(c))
+	h.mut.Unlock()
+
+	switch err {
+	case nil:
+		writeJSON(w, adminResult{"requested"})
+	case errAlreadyPending:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+// handleRecheck makes a pending merge check the build status right away.
+func (a *admin) handleRecheck(w http.ResponseWriter, r *http.Request) {
+	repo, pr, ok := prParams(w, r, "POST")
+	if !ok {
+		return
+	}
+	if !a.handler.pending.recheckMerge(repo, pr) {
+		http.Error(w, "No merge pending", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, adminResult{"rechecking"})
+}
+
+// handleLGTM returns (GET) or clears (DELETE) the LGTMs for the given repo
+// and pr.
+func (a *admin) handleLGTM(w http.ResponseWriter, r *http.Request) {
+	repo, pr, ok := prParams(w, r, "GET", "DELETE")
+	if !ok {
+		return
+	}
+	if r.Method == "DELETE" {
+		if err := a.db.ClearLGTMs(repo, pr); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	lgtms := a.db.LGTMs(repo, pr)
+	if lgtms == nil {
+		lgtms = []string{}
+	}
+	writeJSON(w, lgtms)
+}
+
+// handleHold lists (GET) the holds in a repository, or places (POST) or
+// removes (DELETE) a hold on the given repo and pr.
+func (a *admin) handleHold(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		holds := a.db.Holds(r.URL.Query().Get("repo"))
+		if holds == nil {
+			holds = []hold{}
+		}
+		writeJSON(w, holds)
+		return
+	}
+
+	repo, number, ok := prParams(w, r, "POST", "DELETE")
+	if !ok {
+		return
+	}
+
+	h := a.handler
+	c := a.comment(r, repo, number, "stop")
+	ctx := withLogFields(context.Background(), "repo", repo, "pr", number, "sender", c.Sender.Login, "via", "admin")
+
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	if r.Method == "POST" {
+		if err := h.placeHold(ctx, c, newAuditEntry(c)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, adminResult{"held"})
+		return
+	}
+
+	p, err := c.getPR(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	p.Repository.FullName = repo // only set in events
+	h.releaseHold(ctx, p, "Hold released.")
+	writeJSON(w, adminResult{"released"})
+}
+
+// handleRefreshPermissions empties the permission cache.
+func (a *admin) handleRefreshPermissions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST Expected", http.StatusMethodNotAllowed)
+		return
+	}
+	a.handler.cache.invalidate("")
+	writeJSON(w, adminResult{"refreshed"})
+}
+
+// handleReclone replaces our clone of the given repo with a fresh one.
+func (a *admin) handleReclone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST Expected", http.StatusMethodNotAllowed)
+		return
+	}
+	repo := r.URL.Query().Get("repo")
+	if !validRepoName(repo) {
+		http.Error(w, "repo: expected owner/name", http.StatusBadRequest)
+		return
+	}
+	if err := a.handler.reclone(repo); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, adminResult{"recloned"})
+}
+
+// comment returns a comment for the command on the PR, made by the user
+// given in the request or by the bot itself.
+func (a *admin) comment(r *http.Request, repo string, pr int, command string) comment {
+	sender := r.URL.Query().Get("user")
+	if sender == "" {
+		sender = a.handler.username
+	}
+	return newComment(repo, pr, sender, "@"+a.handler.username+" "+command)
+}
+
+var repoNameRe = regexp.MustCompile(`^[\w.-]+/[\w.-]+$`)
+
+// validRepoName returns true if the name looks like owner/name. We use it
+// as a path, so it must not contain anything else.
+func validRepoName(repo string) bool {
+	return repoNameRe.MatchString(repo) && !strings.Contains(repo, "..")
+}
+
+// prParams checks the request method and returns the repo and pr query
+// parameters. If it returns false an error has been sent.
+func prParams(w http.ResponseWriter, r *http.Request, methods ...string) (string, int, bool) {
+	allowed := false
+	for _, m := range methods {
+		if r.Method == m {
+			allowed = true
+		}
+	}
+	if !allowed {
+		http.Error(w, strings.Join(methods, " or ")+" Expected", http.StatusMethodNotAllowed)
+		return "", 0, false
+	}
+
+	params := r.URL.Query()
+	repo := params.Get("repo")
+	if !validRepoName(repo) {
+		http.Error(w, "repo: expected owner/name", http.StatusBadRequest)
+		return "", 0, false
+	}
+	pr, err := strconv.Atoi(params.Get("pr"))
+	if err != nil || pr <= 0 {
+		http.Error(w, "pr: expected a PR number", http.StatusBadRequest)
+		return "", 0, false
+	}
+	return repo, pr, true
+}
+
+type adminResult struct {
+	Result string `json:"result"`
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAudit(t *testing.T) {
+	os.RemoveAll("_db")
+	defer os.RemoveAll("_db")
+	db, err := OpenDB("_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Audit(auditEntry{Repo: "a/b", PR: 1, Sender: "jb", Command: "merge", Result: auditMerged})
+	db.Audit(auditEntry{Repo: "a/b", PR: 2, Sender: "jb", Command: "merge", Result: auditMerged})
+
+	srv := httptest.NewServer(newAdmin("", "s3cret", db, nil).mux())
+	defer srv.Close()
+
+	get := func(path, token string) *http.Response {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("/audit", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Unexpected status %s without token", resp.Status)
+	}
+
+	resp = get("/audit?pr=x", "s3cret")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected status %s for bad query", resp.Status)
+	}
+
+	resp = get("/audit?repo=a/b&pr=2", "s3cret")
+	defer resp.Body.Close()
+	var entries []auditEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].PR != 2 {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+}
+
+func TestAdminOperations(t *testing.T) {
+	os.RemoveAll("_db")
+	defer os.RemoveAll("_db")
+	db, err := OpenDB("_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A fake GitHub that knows about a/b#1 and records what we post.
+	var posted []string
+	gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/repos/a/b/pulls/1":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"number":       1,
+				"statuses_url": "http://" + r.Host + "/repos/a/b/statuses/abc123",
+			})
+		case r.Method == "POST":
+			posted = append(posted, r.URL.Path)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer gh.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = gh.URL
+
+	audit, _ := newAuditLog(db, "")
+	h := newHandler(nil, "mergebot", "token", false, db, "", "", messageFromCommit, authorsIgnore, nil, newPermCache(time.Minute, time.Minute), newProtectionCache(time.Minute), audit, nil)
+	srv := httptest.NewServer(newAdmin("", "s3cret", db, h).mux())
+	defer srv.Close()
+
+	do := func(method, path string, expected int) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expected {
+			t.Errorf("%s %s: unexpected status %s", method, path, resp.Status)
+		}
+		return resp
+	}
+
+	// Pending merges can be listed and cancelled.
+	pm := h.pending.add(pendingMerge{Repo: "a/b", PR: 2, Requester: "jb", Since: time.Now()})
+	resp := do("GET", "/pending", http.StatusOK)
+	var pending []pendingMerge
+	json.NewDecoder(resp.Body).Decode(&pending)
+	resp.Body.Close()
+	if len(pending) != 1 || pending[0].PR != 2 {
+		t.Errorf("Unexpected pending merges %+v", pending)
+	}
+	do("POST", "/recheck?repo=a/b&pr=2", http.StatusOK).Body.Close()
+	do("POST", "/cancel?repo=a/b&pr=2", http.StatusOK).Body.Close()
+	select {
+	case <-pm.cancel:
+	default:
+		t.Error("Pending merge not cancelled")
+	}
+	do("POST", "/cancel?repo=a/b&pr=2", http.StatusNotFound).Body.Close()
+	do("POST", "/cancel?repo=../b&pr=2", http.StatusBadRequest).Body.Close()
+	do("GET", "/cancel?repo=a/b&pr=2", http.StatusMethodNotAllowed).Body.Close()
+
+	// LGTMs can be cleared.
+	db.LGTM("a/b", 1, "jb")
+	do("DELETE", "/lgtm?repo=a/b&pr=1", http.StatusOK).Body.Close()
+	if lgtms := db.LGTMs("a/b", 1); len(lgtms) != 0 {
+		t.Errorf("LGTMs not cleared: %v", lgtms)
+	}
+
+	// Holds can be placed and released.
+	do("POST", "/hold?repo=a/b&pr=1&user=jb", http.StatusOK).Body.Close()
+	if holds := db.Holds("a/b"); len(holds) != 1 || holds[0].Sender != "jb" {
+		t.Errorf("Unexpected holds %+v", holds)
+	}
+	do("DELETE", "/hold?repo=a/b&pr=1", http.StatusOK).Body.Close()
+	if holds := db.Holds("a/b"); len(holds) != 0 {
+		t.Errorf("Hold not released: %+v", holds)
+	}
+	expected := []string{"/repos/a/b/statuses/abc123", "/repos/a/b/issues/1/comments", "/repos/a/b/statuses/abc123"}
+	if !reflect.DeepEqual(posted, expected) {
+		t.Errorf("Posted %v, expected %v", posted, expected)
+	}
+
+	// The permission cache can be emptied.
+	h.cache.set("collab:a/b:jb", "yes", true)
+	do("POST", "/permissions/refresh", http.StatusOK).Body.Close()
+	if _, ok := h.cache.get("collab:a/b:jb"); ok {
+		t.Error("Permission cache not emptied")
+	}
+}
+
+func TestAdminMerge(t *testing.T) {
+	os.RemoveAll("_db")
+	defer os.RemoveAll("_db")
+	db, err := OpenDB("_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A fake GitHub where a/b#1 has a build in progress.
+	var comments []string
+	gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/repos/a/b/pulls/1":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"number":       1,
+				"statuses_url": "http://" + r.Host + "/repos/a/b/statuses/abc123",
+			})
+		case r.Method == "GET" && r.URL.Path == "/repos/a/b/statuses/abc123":
+			json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"context": "build", "state": "pending"},
+			})
+		case r.Method == "POST" && r.URL.Path == "/repos/a/b/issues/1/comments":
+			var v map[string]string
+			json.NewDecoder(r.Body).Decode(&v)
+			comments = append(comments, v["body"])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer gh.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = gh.URL
+
+	audit, _ := newAuditLog(db, "")
+	h := newHandler(nil, "mergebot", "token", false, db, "", "", messageFromCommit, authorsIgnore, nil, newPermCache(time.Minute, time.Minute), newProtectionCache(time.Minute), audit, nil)
+	srv := httptest.NewServer(newAdmin("", "s3cret", db, h).mux())
+	defer srv.Close()
+
+	do := func(method, path string, expected int) {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Errorf("%s %s: unexpected status %s", method, path, resp.Status)
+		}
+	}
+
+	// The merge waits for the build, and can't be requested twice.
+	do("POST", "/merge?repo=a/b&pr=1&user=jb", http.StatusOK)
+	if pending := h.pending.list(); len(pending) != 1 || pending[0].PR != 1 || pending[0].Requester != "jb" {
+		t.Errorf("Unexpected pending merges %+v", pending)
+	}
+	do("POST", "/merge?repo=a/b&pr=1", http.StatusConflict)
+	do("POST", "/merge?repo=a/b&pr=2", http.StatusBadGateway)
+	do("GET", "/merge?repo=a/b&pr=1", http.StatusMethodNotAllowed)
+
+	do("POST", "/cancel?repo=a/b&pr=1", http.StatusOK)
+	h.shutdown()
+	if len(comments) != 3 || !strings.Contains(comments[0], "@jb") {
+		t.Errorf("Unexpected comments %q", comments)
+	}
+	entries := db.AuditEntries(auditQuery{Repo: "a/b", PR: 1})
+	if len(entries) != 3 || entries[0].Result != auditPending || entries[2].Result != auditCancelled {
+		t.Errorf("Unexpected audit entries %+v", entries)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An auditEntry records a command given to the bot and what came of it.
+type auditEntry struct {
+	Time     time.Time          `json:"time"`
+	Repo     string             `json:"repo"`
+	PR       int                `json:"pr"`
+	Sender   string             `json:"sender"`
+	Command  string             `json:"command"`
+	Allowed  bool               `json:"allowed"`
+	Status   prState            `json:"status,omitempty"`
+	Statuses map[string]prState `json:"statuses,omitempty"`
+	Result   string             `json:"result"`
+	SHA      string             `json:"sha,omitempty"`
+	Retries  map[string]int     `json:"retries,omitempty"` // automatic retries of flaky checks
+}
+
+// Audit results
+const (
+	auditDenied    = "denied"
+	auditMerged    = "merged"
+	auditFailed    = "failed"
+	auditRefused   = "refused"
+	auditPending   = "pending"
+	auditTimeout   = "timeout"
+	auditStopped   = "stopped"
+	auditNoted     = "noted"
+	auditTrigger   = "triggered"
+	auditCancelled = "cancelled"
+	auditScheduled = "scheduled"
+	auditFrozen    = "frozen"
+	auditUnfrozen  = "unfrozen"
+)
+
+func newAuditEntry(c comment) auditEntry {
+	command := c.parseBody().command
+	if fields := strings.Fields(command); len(fields) > 0 {
+		command = strings.ToLower(fields[0])
+	}
+	return auditEntry{
+		Time:    time.Now().UTC(),
+		Repo:    c.Repository.FullName,
+		PR:      c.Issue.Number,
+		Sender:  c.Sender.Login,
+		Command: command,
+		Allowed: true,
+	}
+}
+
+// setStatus records the overall and per context build status.
+func (e *auditEntry) setStatus(overall prState, ss []status) {
+	e.Status = overall
+	e.Statuses = make(map[string]prState, len(ss))
+	for _, s := range ss {
+		e.Statuses[s.Context] = s.State
+	}
+}
+
+// auditQuery selects audit entries. Zero values match anything.
+type auditQuery struct {
+	Repo   string
+	PR     int
+	Sender string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (q auditQuery) matches(e auditEntry) bool {
+	if q.Repo != "" && q.Repo != e.Repo {
+		return false
+	}
+	if q.PR != 0 && q.PR != e.PR {
+		return false
+	}
+	if q.Sender != "" && !strings.EqualFold(q.Sender, e.Sender) {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// The auditLog records entries in the database and, optionally, as JSON
+// lines in a file.
+type auditLog struct {
+	db  *db
+	mut sync.Mutex
+	fd  *os.File
+}
+
+func newAuditLog(db *db, file string) (*auditLog, error) {
+	a := &auditLog{db: db}
+	if file != "" {
+		fd, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.fd = fd
+	}
+	return a, nil
+}
+
+func (a *auditLog) record(e auditEntry) {
+	outcome := e.Result
+	if idx := strings.Index(outcome, ":"); idx > 0 {
+		outcome = outcome[:idx]
+	}
+	metricCommands.WithLabelValues(commandLabel(e.Command), outcome).Inc()
+
+	if err := a.db.Audit(e); err != nil {
+		slog.Error("Audit", "error", err, "repo", e.Repo, "pr", e.PR)
+	}
+
+	if a.fd == nil {
+		return
+	}
+	bs, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Audit", "error", err, "repo", e.Repo, "pr", e.PR)
+		return
+	}
+	a.mut.Lock()
+	_, err = a.fd.Write(append(bs, '\n'))
+	a.mut.Unlock()
+	if err != nil {
+		slog.Error("Audit", "error", err, "repo", e.Repo, "pr", e.PR)
+	}
+}
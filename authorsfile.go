@@ -2,44 +2,272 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
 )
 
-func parseAuthorsFile(r io.Reader) []user {
-	var res []user
+// An author is an entry in an AUTHORS file, on the form
+//
+//	Name Name Name (login) <email1@example.com> <email2@example.com>
+//
+// where the login is optional. The first email address is the primary one
+// and is what the embedded user carries.
+type author struct {
+	user
+	emails []string
+}
+
+// hasEmail returns true if any of the author's email addresses match.
+func (a author) hasEmail(email string) bool {
+	for _, e := range a.emails {
+		if strings.EqualFold(e, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// lineErrors is a list of problems with specific lines in a file.
+type lineErrors []error
+
+func (e lineErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// isLineErrors returns true if the error is about malformed lines only,
+// meaning that whatever could be parsed is still usable.
+func isLineErrors(err error) bool {
+	_, ok := err.(lineErrors)
+	return ok
+}
+
+// parseAuthorsFile parses an AUTHORS file. Blank lines and lines starting
+// with # are ignored. Malformed lines are skipped and reported in the
+// returned error, which is then of the lineErrors type.
+func parseAuthorsFile(r io.Reader) ([]author, error) {
+	var res []author
+	var errs lineErrors
 	sc := bufio.NewScanner(r)
+	lineNo := 0
 	for sc.Scan() {
-		// We assume that neither GitHub username nor email address can
-		// contain any spaces.
-		var u user
-		fields := strings.Fields(sc.Text())
-		for i, field := range fields {
-			if strings.HasPrefix(field, "(") && strings.HasSuffix(field, ")") {
-				u.Name = strings.Join(fields[:i], " ")
-				u.Login = field[1 : len(field)-1]
-				field = fields[i+1]
-				u.Email = field[1 : len(field)-1]
-				break
+		lineNo++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		a, err := parseAuthorsLine(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", lineNo, err))
+			continue
+		}
+		res = append(res, a)
+	}
+	if err := sc.Err(); err != nil {
+		return res, err
+	}
+	if len(errs) > 0 {
+		return res, errs
+	}
+	return res, nil
+}
+
+func parseAuthorsLine(line string) (author, error) {
+	var a author
+
+	name, emails, err := splitEmails(line)
+	if err != nil {
+		return a, err
+	}
+	if len(emails) == 0 {
+		return a, errors.New("no email address")
+	}
+
+	// We assume that the GitHub username can't contain any spaces.
+	if strings.HasSuffix(name, ")") {
+		if idx := strings.LastIndex(name, "("); idx >= 0 {
+			login := name[idx+1 : len(name)-1]
+			if login == "" || strings.ContainsAny(login, " \t()") {
+				return a, fmt.Errorf("invalid login %q", login)
 			}
+			a.Login = login
+			name = strings.TrimSpace(name[:idx])
 		}
-		res = append(res, u)
 	}
-	return res
+	if name == "" {
+		return a, errors.New("no name")
+	}
+
+	a.Name = name
+	a.Email = emails[0]
+	a.emails = emails
+	return a, nil
+}
+
+// splitEmails splits a line on the form "Name <email> <email>" into the
+// name and the list of email addresses. Nothing but addresses may follow
+// the first address.
+func splitEmails(line string) (string, []string, error) {
+	idx := strings.Index(line, "<")
+	if idx < 0 {
+		return strings.TrimSpace(line), nil, nil
+	}
+	name := strings.TrimSpace(line[:idx])
+
+	var emails []string
+	rest := line[idx:]
+	for rest != "" {
+		if rest[0] != '<' {
+			return "", nil, fmt.Errorf("unexpected %q after email address", rest)
+		}
+		end := strings.Index(rest, ">")
+		if end < 0 {
+			return "", nil, errors.New("unterminated email address")
+		}
+		email := strings.TrimSpace(rest[1:end])
+		if email == "" || strings.ContainsAny(email, "< \t") {
+			return "", nil, fmt.Errorf("invalid email address %q", email)
+		}
+		emails = append(emails, email)
+		rest = strings.TrimSpace(rest[end+1:])
+	}
+	return name, emails, nil
 }
 
 func getUserFromFile(login, file string) (user, error) {
+	authors, err := readAuthorsFile(file)
+	if err != nil && !isLineErrors(err) {
+		return user{}, err
+	}
+	if u, ok := findAuthor(authors, login); ok {
+		return u, nil
+	}
+	return user{}, errors.New("not found")
+}
+
+func findAuthor(authors []author, login string) (user, bool) {
+	for _, a := range authors {
+		if a.Login == login {
+			return a.user, true
+		}
+	}
+	return user{}, false
+}
+
+func readAuthorsFile(file string) ([]author, error) {
 	fd, err := os.Open(file)
 	if err != nil {
-		return user{}, err
+		return nil, err
 	}
 	defer fd.Close()
-	for _, user := range parseAuthorsFile(fd) {
-		if user.Login == login {
-			return user, nil
+	return parseAuthorsFile(fd)
+}
+
+// readRepoAuthorsFile reads the AUTHORS file at the tip of the given
+// branch on origin, in the repository in the current directory.
+func readRepoAuthorsFile(branch string) ([]author, error) {
+	s := newScript()
+	s.run("git", "fetch", "-f", "origin", fmt.Sprintf("%s:orig/%s", branch, branch))
+	data := s.run("git", "show", fmt.Sprintf("orig/%s:AUTHORS", branch))
+	if s.Error() != nil {
+		return nil, fmt.Errorf("%s", s.output.String())
+	}
+	return parseAuthorsFile(strings.NewReader(data))
+}
+
+// What to do when the PR author is not listed in the repository AUTHORS
+// file.
+const (
+	authorsIgnore = "ignore" // nothing
+	authorsRefuse = "refuse" // refuse to merge
+	authorsAdd    = "add"    // add them as part of the merge
+)
+
+func validAuthorsMode(mode string) bool {
+	switch mode {
+	case authorsIgnore, authorsRefuse, authorsAdd:
+		return true
+	}
+	return false
+}
+
+type missingAuthorError struct {
+	name  string
+	email string
+	login string
+}
+
+func (e *missingAuthorError) Error() string {
+	return fmt.Sprintf("%s <%s> is not listed in AUTHORS", e.name, e.email)
+}
+
+// authorsFileEntry returns the AUTHORS file line for the given user. The
+// login is left out when we don't know it.
+func authorsFileEntry(u user) string {
+	if u.Login == "" {
+		return fmt.Sprintf("%s <%s>", u.Name, u.Email)
+	}
+	return fmt.Sprintf("%s (%s) <%s>", u.Name, u.Login, u.Email)
+}
+
+// authorLogin returns the GitHub login of the commit author with the given
+// email address, or the empty string when we can't tell. The commits in a
+// PR need not be by whoever opened it, so the PR author's login is only
+// used for their own GitHub noreply address.
+func authorLogin(email, prAuthor string, authors []author) string {
+	for _, a := range authors {
+		if a.Login != "" && a.hasEmail(email) {
+			return a.Login
 		}
 	}
-	return user{}, errors.New("not found")
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || !strings.EqualFold(domain, "users.noreply.github.com") {
+		return ""
+	}
+	if _, login, ok := strings.Cut(local, "+"); ok {
+		// The newer form, ID+login@users.noreply.github.com
+		local = login
+	}
+	if strings.EqualFold(local, prAuthor) {
+		return prAuthor
+	}
+	return ""
+}
+
+// authorsFileLists returns true if the given AUTHORS file contains an
+// entry for the given email address.
+func authorsFileLists(file, email string) (bool, error) {
+	authors, err := readAuthorsFile(file)
+	if err != nil && !isLineErrors(err) {
+		return false, err
+	}
+	for _, a := range authors {
+		if a.hasEmail(email) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// appendAuthorsFile adds an entry for the given user to the end of the
+// AUTHORS file.
+func appendAuthorsFile(file string, u user) error {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(bs) > 0 && !bytes.HasSuffix(bs, []byte("\n")) {
+		bs = append(bs, '\n')
+	}
+	bs = append(bs, authorsFileEntry(u)+"\n"...)
+	return ioutil.WriteFile(file, bs, 0644)
 }
@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestAuthorsFile(t *testing.T) {
 	cases := []struct {
@@ -27,3 +34,138 @@ func TestAuthorsFile(t *testing.T) {
 		}
 	}
 }
+
+func TestAppendAuthorsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mergebot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "AUTHORS")
+	if err := ioutil.WriteFile(file, []byte("Foo Bar (foobar) <foobar@example.com>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if listed, err := authorsFileLists(file, "FooBar@example.com"); err != nil || !listed {
+		t.Error("Expected foobar to be listed", err)
+	}
+	if listed, err := authorsFileLists(file, "new@example.com"); err != nil || listed {
+		t.Error("Expected new to not be listed", err)
+	}
+
+	if err := appendAuthorsFile(file, user{"newbie", "New Person", "new@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if listed, err := authorsFileLists(file, "new@example.com"); err != nil || !listed {
+		t.Error("Expected new to be listed", err)
+	}
+
+	// Without a known login
+	if err := appendAuthorsFile(file, user{"", "Someone Else", "else@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, _ := ioutil.ReadFile(file)
+	expected := "Foo Bar (foobar) <foobar@example.com>\nNew Person (newbie) <new@example.com>\nSomeone Else <else@example.com>\n"
+	if string(bs) != expected {
+		t.Errorf("Got %q, expected %q", bs, expected)
+	}
+}
+
+func TestAuthorLogin(t *testing.T) {
+	authors := []author{
+		{user: user{"foobar", "Foo Bar", "foo@example.com"}, emails: []string{"foo@example.com", "foo@work.example.com"}},
+		{user: user{"", "No Login", "nologin@example.com"}, emails: []string{"nologin@example.com"}},
+	}
+
+	cases := []struct {
+		email    string
+		prAuthor string
+		login    string
+	}{
+		{"foo@work.example.com", "someone", "foobar"},
+		{"nologin@example.com", "someone", ""},
+		{"someone@example.com", "someone", ""},
+		{"someone@users.noreply.github.com", "someone", "someone"},
+		{"1234+Someone@users.noreply.github.com", "someone", "someone"},
+		{"1234+other@users.noreply.github.com", "someone", ""},
+	}
+
+	for _, tc := range cases {
+		if login := authorLogin(tc.email, tc.prAuthor, authors); login != tc.login {
+			t.Errorf("authorLogin(%q, %q) => %q, expected %q", tc.email, tc.prAuthor, login, tc.login)
+		}
+	}
+}
+
+func TestParseAuthorsFile(t *testing.T) {
+	in := `# A comment
+
+Foo Bar (foobar) <foobar@example.com>
+No Login <nologin@example.com> <other@example.com>
+No Email (noemail)
+(nameless) <nameless@example.com>
+Bad Login () <bad@example.com>
+Trailing (trailing) <trailing@example.com> junk
+Unterminated (unterm) <unterm@example.com
+Ends In Login (endsinlogin)
+`
+
+	authors, err := parseAuthorsFile(strings.NewReader(in))
+	expected := []author{
+		{user{"foobar", "Foo Bar", "foobar@example.com"}, []string{"foobar@example.com"}},
+		{user{"", "No Login", "nologin@example.com"}, []string{"nologin@example.com", "other@example.com"}},
+	}
+	if !reflect.DeepEqual(authors, expected) {
+		t.Errorf("Got %+v, expected %+v", authors, expected)
+	}
+
+	errs, ok := err.(lineErrors)
+	if !ok {
+		t.Fatalf("Expected line errors, not %v", err)
+	}
+	var lines []string
+	for _, err := range errs {
+		lines = append(lines, strings.SplitN(err.Error(), ":", 2)[0])
+	}
+	expectedLines := []string{"line 5", "line 6", "line 7", "line 8", "line 9", "line 10"}
+	if !reflect.DeepEqual(lines, expectedLines) {
+		t.Errorf("Got errors on %v, expected %v", lines, expectedLines)
+	}
+}
+
+func FuzzParseAuthorsFile(f *testing.F) {
+	bs, err := ioutil.ReadFile("testdata/AUTHORS")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(string(bs))
+	for _, line := range strings.Split(string(bs), "\n") {
+		f.Add(line)
+	}
+	f.Add("Foo (bar)")
+	f.Add("Foo (bar) <")
+	f.Add("<>")
+
+	f.Fuzz(func(t *testing.T, in string) {
+		authors, err := parseAuthorsFile(strings.NewReader(in))
+		if err != nil && !isLineErrors(err) {
+			return
+		}
+		for _, a := range authors {
+			if a.Name == "" || len(a.emails) == 0 || a.emails[0] != a.Email {
+				t.Errorf("Invalid author %+v parsed from %q", a, in)
+			}
+			if a.Login == "" {
+				continue
+			}
+			// Entries with a login survive a round trip through the
+			// format we write.
+			again, err := parseAuthorsFile(strings.NewReader(authorsFileEntry(a.user)))
+			if err != nil || len(again) != 1 || again[0].user != a.user {
+				t.Errorf("Round trip of %+v failed: %+v, %v", a, again, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const buildkiteAPIURL = "https://api.buildkite.com/v2"
+
+// The buildkiteTrigger creates builds of the PR head in the given
+// pipelines, given as organization/pipeline slugs.
+type buildkiteTrigger struct {
+	url       string // API URL, or empty for the default
+	token     string
+	pipelines []string
+}
+
+type buildkiteBuild struct {
+	Commit                string `json:"commit"`
+	Branch                string `json:"branch"`
+	Message               string `json:"message"`
+	PullRequestID         int    `json:"pull_request_id"`
+	PullRequestBaseBranch string `json:"pull_request_base_branch"`
+}
+
+func (t *buildkiteTrigger) TriggerBuild(ctx context.Context, p pr, pipelines []string) ([]triggeredBuild, error) {
+	if len(pipelines) == 0 {
+		pipelines = t.pipelines
+	}
+	base := t.url
+	if base == "" {
+		base = buildkiteAPIURL
+	}
+
+	build := buildkiteBuild{
+		Commit:                p.Head.SHA,
+		Branch:                fmt.Sprintf("pull/%d/head", p.Number),
+		Message:               fmt.Sprintf("%s (#%d, triggered by mergebot)", p.Title, p.Number),
+		PullRequestID:         p.Number,
+		PullRequestBaseBranch: p.Base.Ref,
+	}
+	bs, _ := json.Marshal(build)
+
+	var errs triggerErrors
+	for _, pipeline := range pipelines {
+		org, slug, ok := strings.Cut(pipeline, "/")
+		if !ok {
+			errs = errs.add(pipeline, errors.New("not organization/pipeline"))
+			continue
+		}
+		u := fmt.Sprintf("%s/organizations/%s/pipelines/%s/builds", base, org, slug)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(bs))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+t.token)
+		errs = errs.add(pipeline, ciDo(req, nil))
+	}
+	return nil, errs.err()
+}
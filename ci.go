@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A CITrigger starts CI builds for a PR. The jobs are build configuration
+// IDs, job names or similar depending on the CI system; when none are
+// given all configured jobs are built. The builds queued are returned, if
+// the CI system tells us about them.
+type CITrigger interface {
+	TriggerBuild(ctx context.Context, p pr, jobs []string) ([]triggeredBuild, error)
+}
+
+// A triggeredBuild is a build queued in the CI system.
+type triggeredBuild struct {
+	Job string
+	ID  string
+	URL string // web page of the build, if known
+}
+
+// triggerErrors holds the errors from triggering each of several jobs.
+type triggerErrors []triggerError
+
+type triggerError struct {
+	job string
+	err error
+}
+
+func (e triggerErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, te := range e {
+		msgs[i] = te.job + ": " + te.err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// add records the error for the job, if it's not nil.
+func (e triggerErrors) add(job string, err error) triggerErrors {
+	if err == nil {
+		return e
+	}
+	return append(e, triggerError{job, err})
+}
+
+// err returns the errors as an error, or nil if there are none.
+func (e triggerErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// CI backend types
+const (
+	ciTeamCity      = "teamcity"
+	ciJenkins       = "jenkins"
+	ciGitHubActions = "github-actions"
+	ciBuildkite     = "buildkite"
+	ciWebhook       = "webhook"
+)
+
+// The ciConfig selects and configures the CI backend for a repository.
+// Values of the form $NAME or ${NAME} are taken from the environment, to
+// keep secrets out of the config file.
+type ciConfig struct {
+	Type     string   `json:"type"`
+	URL      string   `json:"url"`      // server or webhook URL
+	User     string   `json:"user"`     // TeamCity and Jenkins
+	Password string   `json:"password"` // TeamCity, or Jenkins API token
+	Token    string   `json:"token"`    // GitHub Actions, Buildkite and webhook
+	Jobs     []string `json:"jobs"`     // build configuration IDs, job names, workflow files or pipeline slugs
+
+	// The job producing each status context, so that the builds behind
+	// specific or failed checks can be retriggered.
+	Contexts map[string]string `json:"contexts"`
+
+	// Status contexts, as glob patterns, known to fail spuriously. While a
+	// merge is pending they are retriggered up to Retries (default one)
+	// times when they fail.
+	Flaky   []string `json:"flaky"`
+	Retries int      `json:"retries"`
+}
+
+// jobsFor returns the jobs producing the given status contexts, and the
+// contexts we don't know the job for.
+func (c ciConfig) jobsFor(contexts []string) (jobs, unknown []string) {
+	for _, ctx := range contexts {
+		if job, ok := c.Contexts[ctx]; ok {
+			jobs = stringset(jobs).add(job)
+		} else {
+			unknown = append(unknown, ctx)
+		}
+	}
+	return jobs, unknown
+}
+
+func (c ciConfig) validate() error {
+	switch c.Type {
+	case ciTeamCity, ciJenkins, ciWebhook:
+		if c.URL == "" {
+			return fmt.Errorf("ci: %s needs a url", c.Type)
+		}
+	case ciBuildkite:
+		if len(c.Jobs) == 0 {
+			return fmt.Errorf("ci: %s needs jobs", c.Type)
+		}
+		for _, job := range c.Jobs {
+			if !strings.Contains(job, "/") {
+				return fmt.Errorf("ci: %s: pipeline %q is not organization/pipeline", c.Type, job)
+			}
+		}
+	case ciGitHubActions:
+	default:
+		return fmt.Errorf("ci: unknown type %q", c.Type)
+	}
+	if (c.Type == ciTeamCity || c.Type == ciJenkins) && len(c.Jobs) == 0 {
+		return fmt.Errorf("ci: %s needs jobs", c.Type)
+	}
+	if c.Retries < 0 {
+		return fmt.Errorf("ci: negative retries")
+	}
+	for _, pat := range c.Flaky {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("ci: flaky: %q: %v", pat, err)
+		}
+	}
+	return nil
+}
+
+// selectContexts returns the status contexts selected by the arguments to
+// the rebuild command. "failed" selects the contexts whose latest status
+// is failure or error. Anything else is a case insensitive glob pattern
+// matched against the contexts reported for the PR and those we know the
+// jobs for.
+func selectContexts(statuses []status, known map[string]string, args []string) []string {
+	var res []string
+	if len(args) == 1 && strings.EqualFold(args[0], "failed") {
+		for _, s := range statuses {
+			if s.State == stateFailure || s.State == stateError {
+				res = append(res, s.Context)
+			}
+		}
+		return res
+	}
+
+	candidates := make([]string, 0, len(statuses)+len(known))
+	for _, s := range statuses {
+		candidates = append(candidates, s.Context)
+	}
+	for ctx := range known {
+		candidates = append(candidates, ctx)
+	}
+	sort.Strings(candidates[len(statuses):])
+
+	for _, ctx := range candidates {
+		for _, pat := range args {
+			if ok, _ := path.Match(strings.ToLower(pat), strings.ToLower(ctx)); ok {
+				res = stringset(res).add(ctx)
+			}
+		}
+	}
+	return res
+}
+
+// newCITrigger returns the trigger described by the config. The GitHub
+// user name and token are used by GitHub Actions unless another token is
+// configured.
+func newCITrigger(c ciConfig, username, token string) CITrigger {
+	url := strings.TrimSuffix(os.ExpandEnv(c.URL), "/")
+	switch c.Type {
+	case ciTeamCity:
+		return &teamcityTrigger{url: url, user: os.ExpandEnv(c.User), password: os.ExpandEnv(c.Password), buildIDs: c.Jobs}
+	case ciJenkins:
+		return &jenkinsTrigger{url: url, user: os.ExpandEnv(c.User), token: os.ExpandEnv(c.Password), jobs: c.Jobs}
+	case ciGitHubActions:
+		if c.Token != "" {
+			token = os.ExpandEnv(c.Token)
+		}
+		return &actionsTrigger{url: url, username: username, token: token, workflows: c.Jobs}
+	case ciBuildkite:
+		return &buildkiteTrigger{url: url, token: os.ExpandEnv(c.Token), pipelines: c.Jobs}
+	case ciWebhook:
+		return &webhookTrigger{url: url, token: os.ExpandEnv(c.Token)}
+	}
+	return nil
+}
+
+// The webhookTrigger posts a JSON description of the PR to an arbitrary
+// URL, for CI systems we don't otherwise know how to talk to.
+type webhookTrigger struct {
+	url   string
+	token string // sent as a bearer token, if set
+}
+
+type webhookTriggerPayload struct {
+	Repo   string   `json:"repo"`
+	PR     int      `json:"pr"`
+	SHA    string   `json:"sha"`
+	Branch string   `json:"branch"`
+	Base   string   `json:"base"`
+	Jobs   []string `json:"jobs,omitempty"`
+}
+
+func (t *webhookTrigger) TriggerBuild(ctx context.Context, p pr, jobs []string) ([]triggeredBuild, error) {
+	bs, _ := json.Marshal(webhookTriggerPayload{
+		Repo:   p.repo(),
+		PR:     p.Number,
+		SHA:    p.Head.SHA,
+		Branch: fmt.Sprintf("pull/%d", p.Number),
+		Base:   p.Base.Ref,
+		Jobs:   jobs,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return nil, ciDo(req, nil)
+}
+
+// ciDo performs the request and decodes the JSON response into v, if it's
+// not nil. Responses other than 2xx are returned as errors including the
+// start of the response body, as that's usually where CI servers explain
+// what went wrong.
+func ciDo(req *http.Request, v interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		if msg := strings.TrimSpace(string(bs)); msg != "" {
+			return fmt.Errorf("%s: %s", resp.Status, msg)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if v != nil {
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+	return nil
+}
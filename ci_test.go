@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A ciRequest is what the fake CI server saw.
+type ciRequest struct {
+	method string
+	path   string // including the query, if any
+	auth   string
+	body   string
+}
+
+// newFakeCI returns a server recording the requests made to it and
+// answering them with the given status, or with the body of the response
+// for the path if there is one.
+func newFakeCI(status int, responses map[string]string) (*httptest.Server, *[]ciRequest) {
+	var reqs []ciRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		path := r.URL.Path
+		if r.URL.RawQuery != "" {
+			path += "?" + r.URL.RawQuery
+		}
+		if resp, ok := responses[path]; ok {
+			w.Write([]byte(resp))
+			return
+		}
+		reqs = append(reqs, ciRequest{r.Method, path, r.Header.Get("Authorization"), string(bs)})
+		w.WriteHeader(status)
+	}))
+	return srv, &reqs
+}
+
+func testPR() pr {
+	var p pr
+	p.Number = 42
+	p.Title = "lib: Fix thing"
+	p.Head.SHA = "abc123"
+	p.Base.Ref = "main"
+	p.Base.Repo.FullName = "a/b"
+	return p
+}
+
+// newFakeTeamCity returns a server queueing builds of Build with a JSON
+// response, of Test with an XML response, and refusing anything else.
+func newFakeTeamCity(reqs *[]ciRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, _ := ioutil.ReadAll(r.Body)
+		*reqs = append(*reqs, ciRequest{r.Method, r.URL.Path, r.Header.Get("Authorization"), string(bs)})
+		switch {
+		case strings.Contains(string(bs), `id="Build"`):
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id":101,"buildTypeId":"Build","state":"queued","href":"/app/rest/buildQueue/id:101","webUrl":"https://tc/viewQueued.html?itemId=101"}`))
+		case strings.Contains(string(bs), `id="Test"`):
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?><build id="102" buildTypeId="Test" state="queued" href="/app/rest/buildQueue/id:102" webUrl="https://tc/viewQueued.html?itemId=102"><buildType id="Test"/></build>`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Responding with error, status code: 404 (Not Found).\nDetails: jetbrains.buildServer.server.rest.errors.NotFoundException: No build type found\n"))
+		}
+	}))
+}
+
+func TestTeamCityTrigger(t *testing.T) {
+	var reqs []ciRequest
+	srv := newFakeTeamCity(&reqs)
+	defer srv.Close()
+
+	tr := newCITrigger(ciConfig{Type: ciTeamCity, URL: srv.URL + "/", User: "u", Password: "p", Jobs: []string{"Build", "Test"}}, "", "")
+	builds, err := tr.TriggerBuild(context.Background(), testPR(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reqs) != 2 {
+		t.Fatalf("Unexpected requests %+v", reqs)
+	}
+	for i, id := range []string{"Build", "Test"} {
+		r := reqs[i]
+		if r.method != "POST" || r.path != "/httpAuth/app/rest/buildQueue" {
+			t.Errorf("Unexpected request %+v", r)
+		}
+		if !strings.Contains(r.body, `<build branchName="pull/42">`) || !strings.Contains(r.body, `<buildType id="`+id+`"/>`) {
+			t.Errorf("Unexpected body %q", r.body)
+		}
+	}
+
+	expected := []triggeredBuild{
+		{Job: "Build", ID: "#101", URL: "https://tc/viewQueued.html?itemId=101"},
+		{Job: "Test", ID: "#102", URL: "https://tc/viewQueued.html?itemId=102"},
+	}
+	if !reflect.DeepEqual(builds, expected) {
+		t.Errorf("%+v != %+v", builds, expected)
+	}
+}
+
+func TestTeamCityTriggerErrors(t *testing.T) {
+	var reqs []ciRequest
+	srv := newFakeTeamCity(&reqs)
+	defer srv.Close()
+
+	tr := newCITrigger(ciConfig{Type: ciTeamCity, URL: srv.URL, Jobs: []string{"Build", "Nope", "Neither"}}, "", "")
+	builds, err := tr.TriggerBuild(context.Background(), testPR(), nil)
+
+	if len(builds) != 1 || builds[0].Job != "Build" {
+		t.Errorf("Unexpected builds %+v", builds)
+	}
+	errs, ok := err.(triggerErrors)
+	if !ok || len(errs) != 2 || errs[0].job != "Nope" || errs[1].job != "Neither" {
+		t.Fatalf("Unexpected error %#v", err)
+	}
+	if msg := errs[0].err.Error(); msg != "404 Not Found: Responding with error, status code: 404 (Not Found)." {
+		t.Errorf("Unexpected error message %q", msg)
+	}
+}
+
+func TestTeamCityTriggerSelected(t *testing.T) {
+	var reqs []ciRequest
+	srv := newFakeTeamCity(&reqs)
+	defer srv.Close()
+
+	tr := newCITrigger(ciConfig{Type: ciTeamCity, URL: srv.URL, Jobs: []string{"Build", "Test"}}, "", "")
+	if _, err := tr.TriggerBuild(context.Background(), testPR(), []string{"Test"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 1 || !strings.Contains(reqs[0].body, `<buildType id="Test"/>`) {
+		t.Errorf("Unexpected requests %+v", reqs)
+	}
+}
+
+func TestTeamCityFromEnv(t *testing.T) {
+	defer os.Unsetenv("TEAMCITY_SERVER")
+	os.Unsetenv("TEAMCITY_SERVER")
+	if tr := teamcityFromEnv(); tr != nil {
+		t.Errorf("Unexpected trigger %+v", tr)
+	}
+
+	os.Setenv("TEAMCITY_SERVER", "build.example.com")
+	os.Setenv("TEAMCITY_BUILD_IDS", "A,B")
+	os.Setenv("TEAMCITY_CONTEXTS", "Build (Linux)=A, Check=B")
+	defer os.Unsetenv("TEAMCITY_BUILD_IDS")
+	defer os.Unsetenv("TEAMCITY_CONTEXTS")
+	expected := &ciConfig{
+		Type:     ciTeamCity,
+		URL:      "https://build.example.com",
+		Jobs:     []string{"A", "B"},
+		Contexts: map[string]string{"Build (Linux)": "A", "Check": "B"},
+	}
+	if cfg := teamcityFromEnv(); !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("%+v != %+v", cfg, expected)
+	}
+}
+
+func TestJenkinsTrigger(t *testing.T) {
+	srv, reqs := newFakeCI(http.StatusCreated, nil)
+	defer srv.Close()
+
+	tr := newCITrigger(ciConfig{Type: ciJenkins, URL: srv.URL, User: "u", Password: "t", Jobs: []string{"build", "folder/test"}}, "", "")
+	if _, err := tr.TriggerBuild(context.Background(), testPR(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []ciRequest{
+		{"POST", "/job/build/buildWithParameters?BRANCH=pull%2F42&PR=42", "Basic dTp0", ""},
+		{"POST", "/job/folder/job/test/buildWithParameters?BRANCH=pull%2F42&PR=42", "Basic dTp0", ""},
+	}
+	if !reflect.DeepEqual(*reqs, expected) {
+		t.Errorf("%+v != %+v", *reqs, expected)
+	}
+}
+
+func TestActionsTriggerDispatch(t *testing.T) {
+	srv, reqs := newFakeCI(http.StatusNoContent, nil)
+	defer srv.Close()
+
+	tr := newCITrigger(ciConfig{Type: ciGitHubActions, URL: srv.URL, Jobs: []string{"ci.yml"}}, "mergebot", "s3cret")
+	if _, err := tr.TriggerBuild(context.Background(), testPR(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*reqs) != 1 || (*reqs)[0].path != "/repos/a/b/actions/workflows/ci.yml/dispatches" {
+		t.Fatalf("Unexpected requests %+v", *reqs)
+	}
+	var body struct {
+		Ref    string
+		Inputs map[string]string
+	}
+	json.Unmarshal([]byte((*reqs)[0].body), &body)
+	if body.Ref != "main" || body.Inputs["pr"] != "42" {
+		t.Errorf("Unexpected body %q", (*reqs)[0].body)
+	}
+}
+
+func TestActionsTriggerRerun(t *testing.T) {
+	srv, reqs := newFakeCI(http.StatusCreated, map[string]string{
+		"/repos/a/b/actions/runs?head_sha=abc123": `{"workflow_runs": [
+			{"id": 1, "status": "completed", "conclusion": "success"},
+			{"id": 2, "name": "Build", "status": "completed", "conclusion": "failure"},
+			{"id": 3, "status": "in_progress", "conclusion": null}
+		]}`,
+		"/repos/a/c/actions/runs?head_sha=abc123": `{"workflow_runs": []}`,
+	})
+	defer srv.Close()
+
+	tr := newCITrigger(ciConfig{Type: ciGitHubActions, URL: srv.URL}, "mergebot", "s3cret")
+	p := testPR()
+	if _, err := tr.TriggerBuild(context.Background(), p, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(*reqs) != 1 || (*reqs)[0].path != "/repos/a/b/actions/runs/2/rerun-failed-jobs" {
+		t.Errorf("Unexpected requests %+v", *reqs)
+	}
+
+	// Only the failed runs of the named workflows
+	*reqs = nil
+	if _, err := tr.TriggerBuild(context.Background(), p, []string{"Lint"}); err != errNoFailedRuns {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(*reqs) != 0 {
+		t.Errorf("Unexpected requests %+v", *reqs)
+	}
+
+	p.Base.Repo.FullName = "a/c"
+	if _, err := tr.TriggerBuild(context.Background(), p, nil); err != errNoFailedRuns {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestBuildkiteTrigger(t *testing.T) {
+	srv, reqs := newFakeCI(http.StatusCreated, nil)
+	defer srv.Close()
+
+	tr := newCITrigger(ciConfig{Type: ciBuildkite, URL: srv.URL, Token: "s3cret", Jobs: []string{"org/pipeline"}}, "", "")
+	if _, err := tr.TriggerBuild(context.Background(), testPR(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*reqs) != 1 || (*reqs)[0].path != "/organizations/org/pipelines/pipeline/builds" || (*reqs)[0].auth != "Bearer s3cret" {
+		t.Fatalf("Unexpected requests %+v", *reqs)
+	}
+	var build buildkiteBuild
+	json.Unmarshal([]byte((*reqs)[0].body), &build)
+	if build.Commit != "abc123" || build.PullRequestID != 42 || build.PullRequestBaseBranch != "main" {
+		t.Errorf("Unexpected build %+v", build)
+	}
+}
+
+func TestWebhookTrigger(t *testing.T) {
+	srv, reqs := newFakeCI(http.StatusBadRequest, nil)
+	defer srv.Close()
+
+	os.Setenv("MERGEBOT_TEST_TOKEN", "s3cret")
+	defer os.Unsetenv("MERGEBOT_TEST_TOKEN")
+	tr := newCITrigger(ciConfig{Type: ciWebhook, URL: srv.URL + "/hook", Token: "$MERGEBOT_TEST_TOKEN"}, "", "")
+	_, err := tr.TriggerBuild(context.Background(), testPR(), nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "400 Bad Request") {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	if len(*reqs) != 1 || (*reqs)[0].auth != "Bearer s3cret" {
+		t.Fatalf("Unexpected requests %+v", *reqs)
+	}
+	var payload webhookTriggerPayload
+	json.Unmarshal([]byte((*reqs)[0].body), &payload)
+	expected := webhookTriggerPayload{Repo: "a/b", PR: 42, SHA: "abc123", Branch: "pull/42", Base: "main"}
+	if !reflect.DeepEqual(payload, expected) {
+		t.Errorf("%+v != %+v", payload, expected)
+	}
+}
+
+func TestCIConfigValidate(t *testing.T) {
+	cases := []struct {
+		cfg ciConfig
+		ok  bool
+	}{
+		{ciConfig{Type: ciTeamCity, URL: "https://tc", Jobs: []string{"A"}}, true},
+		{ciConfig{Type: ciTeamCity, URL: "https://tc"}, false},
+		{ciConfig{Type: ciJenkins, Jobs: []string{"A"}}, false},
+		{ciConfig{Type: ciGitHubActions}, true},
+		{ciConfig{Type: ciBuildkite, Jobs: []string{"org/pipeline"}}, true},
+		{ciConfig{Type: ciBuildkite, Jobs: []string{"pipeline"}}, false},
+		{ciConfig{Type: ciWebhook, URL: "https://hook"}, true},
+		{ciConfig{Type: "travis"}, false},
+	}
+	for _, tc := range cases {
+		if err := tc.cfg.validate(); (err == nil) != tc.ok {
+			t.Errorf("%+v: unexpected error %v", tc.cfg, err)
+		}
+	}
+}
+
+func TestSelectContexts(t *testing.T) {
+	statuses := []status{
+		{State: stateSuccess, Context: "Build (Linux)"},
+		{State: stateFailure, Context: "Build (Windows)"},
+		{State: stateError, Context: "Check Authors"},
+		{State: statePending, Context: "Check Correctness"},
+	}
+	known := map[string]string{
+		"Build (Linux)":   "BuildLinux",
+		"Build (Windows)": "BuildWindows",
+		"Build (Mac)":     "BuildMac",
+		"Check Authors":   "CheckAuthors",
+	}
+
+	cases := []struct {
+		args []string
+		exp  []string
+	}{
+		{[]string{"failed"}, []string{"Build (Windows)", "Check Authors"}},
+		{[]string{"FAILED"}, []string{"Build (Windows)", "Check Authors"}},
+		{[]string{"build*"}, []string{"Build (Linux)", "Build (Windows)", "Build (Mac)"}},
+		{[]string{"*correctness", "*(mac)"}, []string{"Check Correctness", "Build (Mac)"}},
+		{[]string{"nope"}, nil},
+		{[]string{"[malformed"}, nil},
+	}
+	for _, tc := range cases {
+		res := selectContexts(statuses, known, tc.args)
+		if !reflect.DeepEqual(res, tc.exp) {
+			t.Errorf("%v: %v != %v", tc.args, res, tc.exp)
+		}
+	}
+
+	cfg := ciConfig{Contexts: known}
+	jobs, unknown := cfg.jobsFor([]string{"Build (Windows)", "Check Correctness", "Build (Windows)"})
+	if !reflect.DeepEqual(jobs, []string{"BuildWindows"}) || !reflect.DeepEqual(unknown, []string{"Check Correctness"}) {
+		t.Errorf("Unexpected jobs %v and unknown contexts %v", jobs, unknown)
+	}
+}
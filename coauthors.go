@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// coAuthors returns the Co-authored-by trailer values for the given commit
+// author identities, excluding the main author. Identities are on the
+// usual "Name <email>" form and are canonicalized using the mailmap and
+// AUTHORS file entries, so that someone committing under several names or
+// addresses is only listed once.
+func coAuthors(main string, idents []string, known []author, mm mailmap) []string {
+	seen := make(map[string]bool)
+	_, mainEmail := canonicalIdent(main, known, mm)
+	seen[strings.ToLower(mainEmail)] = true
+
+	var res []string
+	for _, ident := range idents {
+		name, email := canonicalIdent(ident, known, mm)
+		if email == "" || seen[strings.ToLower(email)] {
+			continue
+		}
+		seen[strings.ToLower(email)] = true
+		res = append(res, fmt.Sprintf("%s <%s>", name, email))
+	}
+	return res
+}
+
+// canonicalIdent splits an identity on the "Name <email>" form into name
+// and email, mapped through the mailmap and then replaced with the AUTHORS
+// file entry if there is one with the same email address.
+func canonicalIdent(ident string, known []author, mm mailmap) (string, string) {
+	ident = strings.TrimSpace(ident)
+	start := strings.LastIndex(ident, "<")
+	end := strings.LastIndex(ident, ">")
+	if start < 0 || end < start {
+		return ident, ""
+	}
+	name := strings.TrimSpace(ident[:start])
+	email := strings.TrimSpace(ident[start+1 : end])
+	name, email = mm.lookup(name, email)
+
+	for _, a := range known {
+		if a.hasEmail(email) {
+			return a.Name, a.Email
+		}
+	}
+	return name, email
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCoAuthors(t *testing.T) {
+	known := []author{
+		{user{"foobar", "Foo Bar", "foobar@example.com"}, []string{"foobar@example.com"}},
+		{user{"bazquux", "Baz Quux", "baz@example.com"}, []string{"baz@example.com", "quux@example.com"}},
+	}
+	mm := mailmap{
+		{properName: "Foo Bar", properEmail: "foobar@example.com", commitEmail: "foo@old.example.com"},
+	}
+
+	cases := []struct {
+		main   string
+		idents []string
+		exp    []string
+	}{
+		{"Foo Bar <foobar@example.com>", []string{"Foo Bar <foobar@example.com>"}, nil},
+		{"Foo Bar <foobar@example.com>", []string{"foo <FOOBAR@example.com>", "Other <other@example.com>"}, []string{"Other <other@example.com>"}},
+		{"Other <other@example.com>", []string{"bq <baz@example.com>", "Baz Quux <baz@example.com>"}, []string{"Baz Quux <baz@example.com>"}},
+		{"Other <other@example.com>", []string{"", "no email"}, nil},
+		{"Other <other@example.com>", []string{"bq <quux@example.com>", "Foo <foo@old.example.com>"}, []string{"Baz Quux <baz@example.com>", "Foo Bar <foobar@example.com>"}},
+	}
+
+	for _, tc := range cases {
+		actual := coAuthors(tc.main, tc.idents, known, mm)
+		if !reflect.DeepEqual(actual, tc.exp) {
+			t.Errorf("Got %q, expected %q", actual, tc.exp)
+		}
+	}
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
 )
 
@@ -39,6 +40,22 @@ type comment struct {
 	}
 }
 
+// newComment returns a comment giving the command on the PR, as if made
+// by sender. It's used for commands that don't come from GitHub.
+func newComment(repo string, number int, sender, command string) comment {
+	var c comment
+	c.Comment.User.Login = sender
+	c.Comment.Body = command
+	c.Issue.Number = number
+	c.Issue.URL = fmt.Sprintf("%s/repos/%s/issues/%d", githubAPIURL, repo, number)
+	c.Issue.CommentsURL = c.Issue.URL + "/comments"
+	c.Issue.PullRequest.URL = fmt.Sprintf("%s/repos/%s/pulls/%d", githubAPIURL, repo, number)
+	c.Repository.FullName = repo
+	c.Sender.Login = sender
+	c.Sender.URL = fmt.Sprintf("%s/users/%s", githubAPIURL, sender)
+	return c
+}
+
 type user struct {
 	Login string
 	Name  string
@@ -49,69 +66,69 @@ func (c *comment) parseBody() body {
 	return parseBody(c.Comment.Body)
 }
 
-func (c *comment) post(body, username, token string) {
+func (c *comment) post(ctx context.Context, body, username, token string) {
 	buf := new(bytes.Buffer)
 	json.NewEncoder(buf).Encode(map[string]string{"body": body})
-	req, err := http.NewRequest("POST", c.Issue.CommentsURL, buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", c.Issue.CommentsURL, buf)
 	if err != nil {
-		log.Println("Request:", err)
+		logger(ctx).Error("Request", "error", err)
 		return
 	}
 	req.SetBasicAuth(username, token)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Println("Post:", err)
+		logger(ctx).Error("Post", "error", err)
 		return
 	}
 	resp.Body.Close()
 
 	if resp.StatusCode > 299 {
-		log.Println("Post:", resp.Status)
+		logger(ctx).Error("Post", "status", resp.Status)
 		return
 	}
 }
 
-func (c *comment) close(username, token string) {
+func (c *comment) close(ctx context.Context, username, token string) {
 	buf := new(bytes.Buffer)
 	json.NewEncoder(buf).Encode(map[string]string{"state": "closed"})
-	req, err := http.NewRequest("PATCH", c.Issue.URL, buf)
+	req, err := http.NewRequestWithContext(ctx, "PATCH", c.Issue.URL, buf)
 	if err != nil {
-		log.Println("Request:", err)
+		logger(ctx).Error("Request", "error", err)
 		return
 	}
 	req.SetBasicAuth(username, token)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Println("Post:", err)
+		logger(ctx).Error("Post", "error", err)
 		return
 	}
 	resp.Body.Close()
 
 	if resp.StatusCode > 299 {
-		log.Println("Post:", resp.Status)
+		logger(ctx).Error("Post", "status", resp.Status)
 		return
 	}
 }
 
-func (c *comment) user(username, token string) (user, error) {
-	req, err := http.NewRequest("GET", c.Sender.URL, nil)
+func (c *comment) user(ctx context.Context, username, token string) (user, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.Sender.URL, nil)
 	if err != nil {
-		log.Println("Request:", err)
+		logger(ctx).Error("Request", "error", err)
 		return user{}, err
 	}
 	req.SetBasicAuth(username, token)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Println("Get:", err)
+		logger(ctx).Error("Get", "error", err)
 		return user{}, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode > 299 {
-		log.Println("Post:", resp.Status)
+		logger(ctx).Error("Post", "status", resp.Status)
 		return user{}, err
 	}
 
@@ -124,8 +141,12 @@ func (c *comment) user(username, token string) (user, error) {
 	return u, nil
 }
 
-func (c *comment) getPR() (pr, error) {
-	resp, err := http.Get(c.Issue.PullRequest.URL)
+func (c *comment) getPR(ctx context.Context) (pr, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.Issue.PullRequest.URL, nil)
+	if err != nil {
+		return pr{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return pr{}, err
 	}
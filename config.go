@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// The config file holds settings per repository, keyed by the full
+// repository name. The settings for the "*" repository are the defaults;
+// each setting given for a repository replaces the default one as a whole,
+// while those not given are taken from "*".
+//
+//	{
+//	  "repos": {
+//	    "*": {
+//	      "permissions": {
+//	        "*": ["permission:write"],
+//	        "lgtm": ["permission:triage", "team:reviewers"]
+//	      },
+//	      "ci": {
+//	        "type": "jenkins",
+//	        "url": "https://jenkins.example.com",
+//	        "user": "mergebot",
+//	        "password": "$JENKINS_TOKEN",
+//	        "jobs": ["build", "test"],
+//	        "contexts": {"ci/build": "build", "ci/test": "test"}
+//	      },
+//	      "reviews": {
+//	        "override": ["team:release-managers"]
+//	      }
+//	    }
+//	  }
+//	}
+type config struct {
+	Repos map[string]repoConfig `json:"repos"`
+}
+
+type repoConfig struct {
+	// Who may use each command, keyed by command name or "*" for the
+	// commands not listed. See parseRule for the format of the rules.
+	// When there are no rules, any collaborator may use any command.
+	Permissions map[string][]string `json:"permissions"`
+
+	// The CI system to trigger builds in. When not set, the TeamCity
+	// server given in the environment is used.
+	CI *ciConfig `json:"ci"`
+
+	// When merges may happen. Merge commands outside the merge window are
+	// carried out when it opens, unless given as "merge now".
+	Schedule *scheduleConfig `json:"schedule"`
+
+	// How long and how often to check the build status of pending merges.
+	Wait *waitConfig `json:"wait"`
+
+	// Exceptions to the review requirements of branch protection, which
+	// are otherwise checked before merging. The required status checks
+	// are also taken from branch protection and rulesets, but matched by
+	// context name only: a check pinned to a GitHub App is satisfied by
+	// a status with the same context from any source.
+	Reviews *reviewConfig `json:"reviews"`
+}
+
+func loadConfig(path string) (*config, error) {
+	cfg := new(config)
+	if path == "" {
+		return cfg, nil
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	if err := json.NewDecoder(fd).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *config) validate() error {
+	for repo, rc := range c.Repos {
+		for cmd, rules := range rc.Permissions {
+			for _, r := range rules {
+				if _, err := parseRule(r); err != nil {
+					return fmt.Errorf("%s: %s: %v", repo, cmd, err)
+				}
+			}
+		}
+		if rc.CI != nil {
+			if err := rc.CI.validate(); err != nil {
+				return fmt.Errorf("%s: %v", repo, err)
+			}
+		}
+		if rc.Wait != nil {
+			if err := rc.Wait.validate(); err != nil {
+				return fmt.Errorf("%s: %v", repo, err)
+			}
+		}
+		if rc.Reviews != nil {
+			for _, r := range rc.Reviews.Override {
+				if _, err := parseRule(r); err != nil {
+					return fmt.Errorf("%s: reviews: %v", repo, err)
+				}
+			}
+		}
+		if rc.Schedule != nil {
+			if _, err := newSchedule(rc.Schedule); err != nil {
+				return fmt.Errorf("%s: schedule: %v", repo, err)
+			}
+		}
+	}
+	return nil
+}
+
+// repo returns the settings for the given repository.
+func (c *config) repo(name string) repoConfig {
+	if c == nil {
+		return repoConfig{}
+	}
+	rc := c.Repos["*"]
+	own, ok := c.Repos[name]
+	if !ok {
+		return rc
+	}
+	if own.Permissions != nil {
+		rc.Permissions = own.Permissions
+	}
+	if own.CI != nil {
+		rc.CI = own.CI
+	}
+	if own.Schedule != nil {
+		rc.Schedule = own.Schedule
+	}
+	if own.Wait != nil {
+		rc.Wait = own.Wait
+	}
+	if own.Reviews != nil {
+		rc.Reviews = own.Reviews
+	}
+	return rc
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigRepo(t *testing.T) {
+	perms := map[string][]string{"*": {"permission:write"}}
+	wait := &waitConfig{Interval: duration(time.Minute)}
+	reviews := &reviewConfig{Override: []string{"team:release-managers"}}
+	own := &waitConfig{Interval: duration(time.Second)}
+
+	cfg := &config{Repos: map[string]repoConfig{
+		"*":          {Permissions: perms, Wait: wait},
+		"calmh/foo":  {Wait: own},
+		"calmh/bar":  {Reviews: reviews},
+		"calmh/none": {},
+	}}
+
+	cases := []struct {
+		repo string
+		out  repoConfig
+	}{
+		{"calmh/other", repoConfig{Permissions: perms, Wait: wait}},
+		{"calmh/foo", repoConfig{Permissions: perms, Wait: own}},
+		{"calmh/bar", repoConfig{Permissions: perms, Wait: wait, Reviews: reviews}},
+		{"calmh/none", repoConfig{Permissions: perms, Wait: wait}},
+	}
+
+	for _, tc := range cases {
+		if rc := cfg.repo(tc.repo); !reflect.DeepEqual(rc, tc.out) {
+			t.Errorf("repo(%q) => %+v, expected %+v", tc.repo, rc, tc.out)
+		}
+	}
+
+	var none *config
+	if rc := none.repo("calmh/foo"); !reflect.DeepEqual(rc, repoConfig{}) {
+		t.Errorf("repo on nil config => %+v", rc)
+	}
+}
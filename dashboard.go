@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Number of recent merges and LGTM'd PRs shown per repository.
+const dashboardRecent = 10
+
+// Number of audit log entries to look through for recent merges and
+// active repositories.
+const dashboardAuditScan = 1000
+
+// The dashboard is a read-only HTML page showing, per repository, what the
+// bot is up to.
+type dashboard struct {
+	pending  *pendingMerges
+	db       *db
+	user     string
+	password string
+}
+
+func newDashboard(pending *pendingMerges, db *db, user, password string) *dashboard {
+	return &dashboard{
+		pending:  pending,
+		db:       db,
+		user:     user,
+		password: password,
+	}
+}
+
+type dashboardRepo struct {
+	Name    string
+	Pending []pendingMerge
+	Merges  []auditEntry
+	Holds   []hold
+	LGTMs   []dashboardLGTM
+}
+
+type dashboardLGTM struct {
+	PR    int
+	Count int
+}
+
+type dashboardPage struct {
+	Now   time.Time
+	Repos []*dashboardRepo
+}
+
+func (d *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if d.password != "" {
+		user, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(d.user)) != 1 || subtle.ConstantTimeCompare([]byte(password), []byte(d.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mergebot"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.Method != "GET" {
+		http.Error(w, "GET Expected", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTpl.Execute(w, d.page(r.URL.Query().Get("repo"))); err != nil {
+		slog.Error("Rendering dashboard", "error", err)
+	}
+}
+
+// page collects the dashboard contents for the given repository, or all
+// repositories we know about if repo is empty.
+func (d *dashboard) page(repo string) dashboardPage {
+	repos := make(map[string]*dashboardRepo)
+	get := func(name string) *dashboardRepo {
+		dr, ok := repos[name]
+		if !ok {
+			dr = &dashboardRepo{Name: name}
+			repos[name] = dr
+		}
+		return dr
+	}
+
+	for _, pm := range d.pending.list() {
+		if repo == "" || pm.Repo == repo {
+			dr := get(pm.Repo)
+			dr.Pending = append(dr.Pending, pm)
+		}
+	}
+
+	for _, h := range d.db.Holds(repo) {
+		dr := get(h.Repo)
+		dr.Holds = append(dr.Holds, h)
+	}
+
+	// The audit log only grows, so we look at the most recent part of it.
+	scanned := 0
+	d.db.RecentAuditEntries(func(e auditEntry) bool {
+		scanned++
+		if repo == "" || e.Repo == repo {
+			dr := get(e.Repo)
+			if e.Result == auditMerged && len(dr.Merges) < dashboardRecent {
+				dr.Merges = append(dr.Merges, e)
+			}
+			if repo != "" && len(dr.Merges) == dashboardRecent {
+				return false
+			}
+		}
+		return scanned < dashboardAuditScan
+	})
+
+	var page dashboardPage
+	page.Now = time.Now()
+	for _, dr := range repos {
+		for pr, count := range d.db.LGTMCounts(dr.Name) {
+			dr.LGTMs = append(dr.LGTMs, dashboardLGTM{PR: pr, Count: count})
+		}
+		sort.Slice(dr.LGTMs, func(a, b int) bool {
+			return dr.LGTMs[a].PR > dr.LGTMs[b].PR
+		})
+		if len(dr.LGTMs) > dashboardRecent {
+			dr.LGTMs = dr.LGTMs[:dashboardRecent]
+		}
+		page.Repos = append(page.Repos, dr)
+	}
+	sort.Slice(page.Repos, func(a, b int) bool {
+		return page.Repos[a].Name < page.Repos[b].Name
+	})
+	return page
+}
+
+var dashboardTpl = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"since": func(now, t time.Time) string {
+		return now.Sub(t).Truncate(time.Second).String()
+	},
+	"short": func(sha string) string {
+		if len(sha) > 8 {
+			return sha[:8]
+		}
+		return sha
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mergebot</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+.success { color: green; }
+.pending { color: orange; }
+.failure, .error { color: red; }
+</style>
+</head>
+<body>
+<h1>mergebot</h1>
+{{$now := .Now}}
+{{range .Repos}}
+<h2><a href="?repo={{.Name}}">{{.Name}}</a></h2>
+
+<h3>Pending merges</h3>
+{{if .Pending}}
+<table>
+<tr><th>PR</th><th>Requested by</th><th>Waiting</th><th>Status</th></tr>
+{{range .Pending}}
+<tr>
+<td><a href="https://github.com/{{.Repo}}/pull/{{.PR}}">#{{.PR}}</a></td>
+<td>{{.Requester}}</td>
+<td>{{since $now .Since}}</td>
+<td>{{if not .Scheduled.IsZero}}scheduled for {{.Scheduled.Format "2006-01-02 15:04 MST"}}{{else}}<span class="{{.Status}}">{{.Status}}</span>{{end}}{{range .Statuses}}<br><span class="{{.State}}">{{.Context}}: {{.State}}</span>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}<p>None.</p>{{end}}
+
+<h3>Holds</h3>
+{{if .Holds}}
+<table>
+<tr><th>PR</th><th>Held by</th><th>Since</th></tr>
+{{range .Holds}}
+<tr>
+<td><a href="https://github.com/{{.Repo}}/pull/{{.PR}}">#{{.PR}}</a></td>
+<td>{{.Sender}}</td>
+<td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}<p>None.</p>{{end}}
+
+<h3>Recent merges</h3>
+{{if .Merges}}
+<table>
+<tr><th>PR</th><th>Commit</th><th>Requested by</th><th>Merged</th></tr>
+{{range .Merges}}
+<tr>
+<td><a href="https://github.com/{{.Repo}}/pull/{{.PR}}">#{{.PR}}</a></td>
+<td><a href="https://github.com/{{.Repo}}/commit/{{.SHA}}"><code>{{short .SHA}}</code></a></td>
+<td>{{.Sender}}</td>
+<td>{{.Time.Format "2006-01-02 15:04:05 MST"}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}<p>None.</p>{{end}}
+
+<h3>LGTMs</h3>
+{{if .LGTMs}}
+<table>
+<tr><th>PR</th><th>LGTMs</th></tr>
+{{range .LGTMs}}
+<tr><td>#{{.PR}}</td><td>{{.Count}}</td></tr>
+{{end}}
+</table>
+{{else}}<p>None.</p>{{end}}
+{{else}}
+<p>Nothing to show yet.</p>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboard(t *testing.T) {
+	os.RemoveAll("_db")
+	defer os.RemoveAll("_db")
+	db, err := OpenDB("_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	pending := newPendingMerges()
+	pm := pending.add(pendingMerge{
+		Repo:      "a/b",
+		PR:        12,
+		Requester: "jb",
+		Since:     time.Now().Add(-time.Minute),
+		Status:    statePending,
+		Statuses:  []status{{State: stateSuccess, Context: "build"}, {State: statePending, Context: "<test>"}},
+	})
+	defer pending.remove(pm)
+	db.Audit(auditEntry{Repo: "a/b", PR: 10, Sender: "ab", Command: "merge", Result: auditMerged, SHA: "0123456789abcdef"})
+	db.Audit(auditEntry{Repo: "a/c", PR: 11, Sender: "ab", Command: "merge", Result: auditFailed})
+	db.Hold(hold{Repo: "a/c", PR: 13, Sender: "cd", Time: time.Now()})
+	db.LGTM("a/b", 14, "jb")
+
+	srv := httptest.NewServer(newDashboard(pending, db, "admin", "s3cret"))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Unexpected status %s without credentials", resp.Status)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.SetBasicAuth("admin", "s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	page := string(bs)
+
+	for _, exp := range []string{
+		"<h2><a href=\"?repo=a%2fb\">a/b</a></h2>",
+		"<h2><a href=\"?repo=a%2fc\">a/c</a></h2>",
+		"https://github.com/a/b/pull/12",
+		"&lt;test&gt;: pending",
+		"<code>01234567</code>",
+		"https://github.com/a/c/pull/13",
+		"<td>#14</td><td>1</td>",
+	} {
+		if !strings.Contains(page, exp) {
+			t.Errorf("Page does not contain %q", exp)
+		}
+	}
+	if strings.Contains(page, "pull/11") {
+		t.Error("Page shows failed merge")
+	}
+}
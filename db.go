@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"encoding/json"
@@ -15,7 +19,10 @@ type db struct {
 }
 
 var (
-	lgtmBucket = []byte("lgtm")
+	lgtmBucket   = []byte("lgtm")
+	auditBucket  = []byte("audit")
+	holdBucket   = []byte("hold")
+	freezeBucket = []byte("freeze")
 )
 
 func OpenDB(path string) (*db, error) {
@@ -31,8 +38,12 @@ func OpenDB(path string) (*db, error) {
 	go db.Serve()
 
 	err = db.db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(lgtmBucket)
-		return err
+		for _, b := range [][]byte{lgtmBucket, auditBucket, holdBucket, freezeBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 	if err != nil {
 		db.db.Close()
@@ -46,19 +57,52 @@ func (db *db) Serve() {
 	select {}
 }
 
+// Ready returns nil if the database is open and usable.
+func (db *db) Ready() error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(lgtmBucket) == nil {
+			return errors.New("missing bucket")
+		}
+		return nil
+	})
+}
+
 func (db *db) Close() error {
 	return db.db.Close()
 }
 
-func (db *db) LGTM(pr int, user string) {
-	key := []byte(fmt.Sprintf("pr-%d", pr))
+// prKey is the database key for things relating to a given PR.
+func prKey(repo string, pr int) []byte {
+	return []byte(fmt.Sprintf("%s#%d", repo, pr))
+}
+
+// legacyLGTMKey is where LGTMs were kept before we knew about more than
+// one repository. They are still read, and moved to the current key when
+// the PR gets another LGTM.
+func legacyLGTMKey(pr int) []byte {
+	return []byte(fmt.Sprintf("pr-%d", pr))
+}
+
+// getLGTMs returns the LGTMs for the PR, from the legacy key if there are
+// none under the current one.
+func getLGTMs(tx *bolt.Tx, repo string, pr int) []string {
+	b := tx.Bucket(lgtmBucket)
+	bs := b.Get(prKey(repo, pr))
+	if bs == nil {
+		bs = b.Get(legacyLGTMKey(pr))
+	}
+	var lgtms []string
+	if bs != nil {
+		json.Unmarshal(bs, &lgtms) // ignore error
+	}
+	return lgtms
+}
+
+func (db *db) LGTM(repo string, pr int, user string) {
+	key := prKey(repo, pr)
 	//db.inbox <- func() {
 	db.db.Update(func(tx *bolt.Tx) error {
-		var curLGTM []string
-		curVal := tx.Bucket(lgtmBucket).Get(key)
-		if curVal != nil {
-			json.Unmarshal(curVal, &curLGTM) // ignore error
-		}
+		curLGTM := getLGTMs(tx, repo, pr)
 		for _, ex := range curLGTM {
 			if ex == user {
 				// we're done
@@ -67,21 +111,195 @@ func (db *db) LGTM(pr int, user string) {
 		}
 		curLGTM = append(curLGTM, user)
 		bs, _ := json.Marshal(curLGTM)
+		if err := tx.Bucket(lgtmBucket).Delete(legacyLGTMKey(pr)); err != nil {
+			return err
+		}
 		return tx.Bucket(lgtmBucket).Put(key, bs)
 	})
 	//}
 }
 
-func (db *db) LGTMs(pr int) []string {
-	key := []byte(fmt.Sprintf("pr-%d", pr))
+func (db *db) LGTMs(repo string, pr int) []string {
 	var lgtms []string
 	db.db.View(func(tx *bolt.Tx) error {
-		bs := tx.Bucket(lgtmBucket).Get(key)
+		lgtms = getLGTMs(tx, repo, pr)
+		return nil
+	})
+	return lgtms
+}
+
+func (db *db) ClearLGTMs(repo string, pr int) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(lgtmBucket).Delete(legacyLGTMKey(pr)); err != nil {
+			return err
+		}
+		return tx.Bucket(lgtmBucket).Delete(prKey(repo, pr))
+	})
+}
+
+// LGTMCounts returns the number of LGTMs per PR in the repository.
+func (db *db) LGTMCounts(repo string) map[int]int {
+	res := make(map[int]int)
+	prefix := []byte(repo + "#")
+	db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(lgtmBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var pr int
+			if _, err := fmt.Sscanf(string(k[len(prefix):]), "%d", &pr); err != nil {
+				continue
+			}
+			var lgtms []string
+			json.Unmarshal(v, &lgtms)
+			res[pr] = len(lgtms)
+		}
+		return nil
+	})
+	return res
+}
+
+// A hold is placed on a PR by the stop command and lasts until the PR is
+// updated or closed.
+type hold struct {
+	Repo   string    `json:"repo"`
+	PR     int       `json:"pr"`
+	Sender string    `json:"sender"`
+	Time   time.Time `json:"time"`
+}
+
+func (db *db) Hold(h hold) error {
+	bs, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(holdBucket).Put(prKey(h.Repo, h.PR), bs)
+	})
+}
+
+func (db *db) Unhold(repo string, pr int) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(holdBucket).Delete(prKey(repo, pr))
+	})
+}
+
+// Holds returns the holds in the repository, or in all repositories if
+// repo is empty, oldest first.
+func (db *db) Holds(repo string) []hold {
+	var res []hold
+	db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(holdBucket).ForEach(func(_, bs []byte) error {
+			var h hold
+			if err := json.Unmarshal(bs, &h); err != nil {
+				return nil // skip it
+			}
+			if repo == "" || h.Repo == repo {
+				res = append(res, h)
+			}
+			return nil
+		})
+	})
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].Time.Before(res[b].Time)
+	})
+	return res
+}
+
+// A freeze stops all merges to a branch, until lifted.
+type freeze struct {
+	Repo   string    `json:"repo"`
+	Branch string    `json:"branch"`
+	Sender string    `json:"sender"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+func freezeKey(repo, branch string) []byte {
+	return []byte(repo + ":" + branch)
+}
+
+func (db *db) Freeze(f freeze) error {
+	bs, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(freezeBucket).Put(freezeKey(f.Repo, f.Branch), bs)
+	})
+}
+
+func (db *db) Unfreeze(repo, branch string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(freezeBucket).Delete(freezeKey(repo, branch))
+	})
+}
+
+// Frozen returns the freeze of the branch, if there is one.
+func (db *db) Frozen(repo, branch string) (freeze, bool) {
+	var f freeze
+	var ok bool
+	db.db.View(func(tx *bolt.Tx) error {
+		bs := tx.Bucket(freezeBucket).Get(freezeKey(repo, branch))
 		if bs == nil {
 			return nil
 		}
-		json.Unmarshal(bs, &lgtms)
+		ok = json.Unmarshal(bs, &f) == nil
 		return nil
 	})
-	return lgtms
+	return f, ok
+}
+
+// Audit appends the entry to the audit log. Entries are keyed by sequence
+// number and so kept in the order they were added.
+func (db *db) Audit(e auditEntry) error {
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return db.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return b.Put(key, bs)
+	})
+}
+
+// RecentAuditEntries calls fn with the audit log entries, newest first,
+// for as long as it returns true.
+func (db *db) RecentAuditEntries(fn func(e auditEntry) bool) {
+	db.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(auditBucket).Cursor()
+		for k, bs := c.Last(); k != nil; k, bs = c.Prev() {
+			var e auditEntry
+			if err := json.Unmarshal(bs, &e); err != nil {
+				continue // skip it
+			}
+			if !fn(e) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// AuditEntries returns the audit log entries matching the query, oldest
+// first.
+func (db *db) AuditEntries(q auditQuery) []auditEntry {
+	var res []auditEntry
+	db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(auditBucket).ForEach(func(_, bs []byte) error {
+			var e auditEntry
+			if err := json.Unmarshal(bs, &e); err != nil {
+				return nil // skip it
+			}
+			if q.matches(e) {
+				res = append(res, e)
+			}
+			return nil
+		})
+	})
+	return res
 }
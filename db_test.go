@@ -4,6 +4,9 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
 )
 
 func TestLGTMPersistence(t *testing.T) {
@@ -15,18 +18,139 @@ func TestLGTMPersistence(t *testing.T) {
 	}
 	defer db.Close()
 
-	lgtms := db.LGTMs(1234)
+	lgtms := db.LGTMs("a/b", 1234)
 	expected := []string(nil)
 	if !reflect.DeepEqual(lgtms, expected) {
 		t.Errorf("%+v != %+v", lgtms, expected)
 	}
 
-	db.LGTM(1234, "jb")
-	db.LGTM(1234, "ab")
+	db.LGTM("a/b", 1234, "jb")
+	db.LGTM("a/b", 1234, "ab")
 
-	lgtms = db.LGTMs(1234)
+	lgtms = db.LGTMs("a/b", 1234)
 	expected = []string{"jb", "ab"}
 	if !reflect.DeepEqual(lgtms, expected) {
 		t.Errorf("%+v != %+v", lgtms, expected)
 	}
+
+	db.LGTM("a/b", 12, "jb")
+	db.LGTM("a/bc", 1234, "jb")
+	if lgtms := db.LGTMs("a/bc", 1234); len(lgtms) != 1 {
+		t.Errorf("LGTMs leaked between repositories: %+v", lgtms)
+	}
+	counts := db.LGTMCounts("a/b")
+	if !reflect.DeepEqual(counts, map[int]int{12: 1, 1234: 2}) {
+		t.Errorf("Unexpected counts %+v", counts)
+	}
+}
+
+func TestLegacyLGTMs(t *testing.T) {
+	os.RemoveAll("_db")
+	defer os.RemoveAll("_db")
+	db, err := OpenDB("_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// LGTMs stored by earlier versions, without the repository
+	db.db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket(lgtmBucket).Put([]byte("pr-12"), []byte(`["jb"]`))
+		return tx.Bucket(lgtmBucket).Put([]byte("pr-34"), []byte(`["ab"]`))
+	})
+
+	if lgtms := db.LGTMs("a/b", 12); !reflect.DeepEqual(lgtms, []string{"jb"}) {
+		t.Errorf("Legacy LGTMs lost: %+v", lgtms)
+	}
+
+	// Another LGTM moves them to the current key
+	db.LGTM("a/b", 12, "ab")
+	if lgtms := db.LGTMs("a/b", 12); !reflect.DeepEqual(lgtms, []string{"jb", "ab"}) {
+		t.Errorf("Unexpected LGTMs %+v", lgtms)
+	}
+	if counts := db.LGTMCounts("a/b"); !reflect.DeepEqual(counts, map[int]int{12: 2}) {
+		t.Errorf("Unexpected counts %+v", counts)
+	}
+
+	// Merging clears them
+	if err := db.ClearLGTMs("a/b", 34); err != nil {
+		t.Fatal(err)
+	}
+	if lgtms := db.LGTMs("a/b", 34); lgtms != nil {
+		t.Errorf("Legacy LGTMs not cleared: %+v", lgtms)
+	}
+}
+
+func TestHolds(t *testing.T) {
+	os.RemoveAll("_db")
+	defer os.RemoveAll("_db")
+	db, err := OpenDB("_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t0 := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	db.Hold(hold{Repo: "a/b", PR: 2, Sender: "jb", Time: t0.Add(time.Minute)})
+	db.Hold(hold{Repo: "a/b", PR: 1, Sender: "ab", Time: t0})
+	db.Hold(hold{Repo: "a/c", PR: 1, Sender: "jb", Time: t0})
+
+	if holds := db.Holds("a/b"); len(holds) != 2 || holds[0].PR != 1 || holds[1].PR != 2 {
+		t.Errorf("Unexpected holds %+v", holds)
+	}
+
+	db.Unhold("a/b", 1)
+	if holds := db.Holds(""); len(holds) != 2 || holds[0].Repo != "a/c" {
+		t.Errorf("Unexpected holds %+v", holds)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	os.RemoveAll("_db")
+	defer os.RemoveAll("_db")
+	db, err := OpenDB("_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t0 := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []auditEntry{
+		{Time: t0, Repo: "a/b", PR: 1, Sender: "jb", Command: "merge", Allowed: true, Result: auditPending},
+		{Time: t0.Add(time.Minute), Repo: "a/b", PR: 1, Sender: "jb", Command: "merge", Allowed: true, Result: auditMerged, SHA: "abc123"},
+		{Time: t0.Add(2 * time.Minute), Repo: "a/c", PR: 1, Sender: "ab", Command: "lgtm", Result: auditDenied},
+	}
+	for _, e := range entries {
+		if err := db.Audit(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		q   auditQuery
+		exp []auditEntry
+	}{
+		{auditQuery{}, entries},
+		{auditQuery{Repo: "a/b"}, entries[:2]},
+		{auditQuery{PR: 1, Sender: "AB"}, entries[2:]},
+		{auditQuery{Since: t0.Add(time.Minute)}, entries[1:]},
+		{auditQuery{Until: t0.Add(time.Minute)}, entries[:1]},
+		{auditQuery{PR: 2}, nil},
+	}
+	for i, tc := range cases {
+		res := db.AuditEntries(tc.q)
+		if !reflect.DeepEqual(res, tc.exp) {
+			t.Errorf("%d: %+v != %+v", i, res, tc.exp)
+		}
+	}
+
+	// Newest first, stopping when asked to
+	var recent []auditEntry
+	db.RecentAuditEntries(func(e auditEntry) bool {
+		recent = append(recent, e)
+		return len(recent) < 2
+	})
+	if !reflect.DeepEqual(recent, []auditEntry{entries[2], entries[1]}) {
+		t.Errorf("Unexpected recent entries %+v", recent)
+	}
 }
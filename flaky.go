@@ -0,0 +1,98 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// flakyRetries keeps track of the automatic retries of flaky checks while
+// a merge is pending.
+type flakyRetries struct {
+	patterns []string
+	max      int
+	jobs     map[string]string // job producing each context
+	counts   map[string]int    // retries so far per context
+	failed   map[string]int64  // ID of the last failed status retried per context
+}
+
+// newFlakyRetries returns the retry state for a repository with the given
+// CI configuration, which may be nil.
+func newFlakyRetries(cc *ciConfig) *flakyRetries {
+	r := &flakyRetries{
+		counts: make(map[string]int),
+		failed: make(map[string]int64),
+	}
+	if cc != nil {
+		r.patterns = cc.Flaky
+		r.max = cc.Retries
+		if r.max == 0 {
+			r.max = 1
+		}
+		r.jobs = cc.Contexts
+	}
+	return r
+}
+
+func (r *flakyRetries) isFlaky(context string) bool {
+	for _, pat := range r.patterns {
+		if ok, _ := path.Match(strings.ToLower(pat), strings.ToLower(context)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mask returns the statuses with the failures we've retried, but that the
+// CI system hasn't reported on again yet, as pending.
+func (r *flakyRetries) mask(ss []status) []status {
+	res := make([]status, len(ss))
+	copy(res, ss)
+	for i, s := range res {
+		if id, ok := r.failed[s.Context]; ok && id == s.ID && isFailed(s.State) {
+			res[i].State = statePending
+		}
+	}
+	return res
+}
+
+// retryable returns the failed contexts that are flaky, have retries left
+// and that we know how to retrigger.
+func (r *flakyRetries) retryable(ss []status) []string {
+	var res []string
+	for _, s := range ss {
+		if !isFailed(s.State) || !r.isFlaky(s.Context) || r.counts[s.Context] >= r.max {
+			continue
+		}
+		if _, ok := r.jobs[s.Context]; !ok {
+			continue
+		}
+		res = append(res, s.Context)
+	}
+	return res
+}
+
+// retried records that the given contexts were retriggered.
+func (r *flakyRetries) retried(ss []status, contexts []string) {
+	for _, s := range ss {
+		if stringset(contexts).contains(s.Context) {
+			r.counts[s.Context]++
+			r.failed[s.Context] = s.ID
+		}
+	}
+}
+
+// withPending returns the statuses with the given contexts as pending.
+func withPending(ss []status, contexts []string) []status {
+	res := make([]status, len(ss))
+	copy(res, ss)
+	for i, s := range res {
+		if stringset(contexts).contains(s.Context) {
+			res[i].State = statePending
+		}
+	}
+	return res
+}
+
+func isFailed(state prState) bool {
+	return state == stateFailure || state == stateError
+}
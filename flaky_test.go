@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFlakyRetries(t *testing.T) {
+	r := newFlakyRetries(&ciConfig{
+		Flaky:    []string{"build (*)"},
+		Retries:  2,
+		Contexts: map[string]string{"Build (Linux)": "BuildLinux", "Build (Mac)": "BuildMac"},
+	})
+
+	statuses := []status{
+		{ID: 1, State: stateFailure, Context: "Build (Linux)"},
+		{ID: 2, State: stateError, Context: "Build (Windows)"}, // no job known
+		{ID: 3, State: stateSuccess, Context: "Build (Mac)"},
+		{ID: 4, State: stateFailure, Context: "Check Authors"}, // not flaky
+	}
+
+	retry := r.retryable(statuses)
+	if !reflect.DeepEqual(retry, []string{"Build (Linux)"}) {
+		t.Fatalf("Unexpected retryable contexts %v", retry)
+	}
+	r.retried(statuses, retry)
+
+	// Until there's a new status for the context, it's pending.
+	masked := r.mask(statuses)
+	if masked[0].State != statePending || statuses[0].State != stateFailure {
+		t.Errorf("Unexpected masking %+v", masked)
+	}
+	if len(r.retryable(masked)) != 0 {
+		t.Error("Retryable while waiting for the retry")
+	}
+
+	// A second failure may be retried, but not a third.
+	statuses[0].ID = 5
+	if masked := r.mask(statuses); masked[0].State != stateFailure {
+		t.Errorf("New failure masked %+v", masked[0])
+	}
+	if retry := r.retryable(statuses); len(retry) != 1 {
+		t.Fatalf("Unexpected retryable contexts %v", retry)
+	}
+	r.retried(statuses, retry)
+	statuses[0].ID = 6
+	if retry := r.retryable(statuses); len(retry) != 0 {
+		t.Errorf("Unexpected retryable contexts %v", retry)
+	}
+	if !reflect.DeepEqual(r.counts, map[string]int{"Build (Linux)": 2}) {
+		t.Errorf("Unexpected counts %v", r.counts)
+	}
+}
+
+func TestFlakyRetriesUnconfigured(t *testing.T) {
+	r := newFlakyRetries(nil)
+	statuses := []status{{ID: 1, State: stateFailure, Context: "Build"}}
+	if retry := r.retryable(statuses); len(retry) != 0 {
+		t.Errorf("Unexpected retryable contexts %v", retry)
+	}
+	if !reflect.DeepEqual(r.mask(statuses), statuses) {
+		t.Error("Unexpected masking")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// handleFreeze handles "freeze <branch> [reason]", stopping all merges to
+// the branch until it's unfrozen.
+func (h *handler) handleFreeze(ctx context.Context, c comment) {
+	e := newAuditEntry(c)
+	if !h.isAllowed(ctx, c.Repository.FullName, "freeze", c.Sender.Login) {
+		c.post(ctx, noAccessResponse(c), h.username, h.token)
+		logger(ctx).Info("Rejecting request by unknown user")
+		h.auditDenied(e)
+		return
+	}
+
+	fields := strings.Fields(c.parseBody().command)
+	if len(fields) < 2 {
+		c.post(ctx, freezeUsageResponse(c), h.username, h.token)
+		e.Result = auditRefused + ": no branch given"
+		h.audit.record(e)
+		return
+	}
+
+	f := freeze{
+		Repo:   c.Repository.FullName,
+		Branch: fields[1],
+		Sender: c.Sender.Login,
+		Time:   time.Now().UTC(),
+		Reason: strings.Join(fields[2:], " "),
+	}
+
+	// The freeze is recorded under the lock so that it takes effect
+	// before any merge that hasn't got under way yet. Updating the
+	// statuses can take a while and happens after.
+	h.mut.Lock()
+	err := h.db.Freeze(f)
+	h.mut.Unlock()
+	if err != nil {
+		logger(ctx).Error("Recording freeze", "error", err)
+		c.post(ctx, errorResponse(c, err.Error()), h.username, h.token)
+		e.Result = auditFailed + ": " + err.Error()
+		h.audit.record(e)
+		return
+	}
+	logger(ctx).Info("Froze branch", "branch", f.Branch, "reason", f.Reason)
+
+	h.setBranchStatus(ctx, f.Repo, f.Branch, stateFailure, frozenDescription(f))
+	c.post(ctx, frozenResponse(c, f), h.username, h.token)
+	e.Result = auditFrozen
+	h.audit.record(e)
+}
+
+// handleUnfreeze handles "unfreeze <branch>".
+func (h *handler) handleUnfreeze(ctx context.Context, c comment) {
+	e := newAuditEntry(c)
+	if !h.isAllowed(ctx, c.Repository.FullName, "unfreeze", c.Sender.Login) {
+		c.post(ctx, noAccessResponse(c), h.username, h.token)
+		logger(ctx).Info("Rejecting request by unknown user")
+		h.auditDenied(e)
+		return
+	}
+
+	fields := strings.Fields(c.parseBody().command)
+	if len(fields) < 2 {
+		c.post(ctx, freezeUsageResponse(c), h.username, h.token)
+		e.Result = auditRefused + ": no branch given"
+		h.audit.record(e)
+		return
+	}
+	repo, branch := c.Repository.FullName, fields[1]
+
+	h.mut.Lock()
+	_, frozen := h.db.Frozen(repo, branch)
+	var err error
+	if frozen {
+		err = h.db.Unfreeze(repo, branch)
+	}
+	h.mut.Unlock()
+
+	if !frozen {
+		c.post(ctx, notFrozenResponse(c, branch), h.username, h.token)
+		e.Result = auditRefused + ": not frozen"
+		h.audit.record(e)
+		return
+	}
+	if err != nil {
+		logger(ctx).Error("Removing freeze", "error", err)
+		c.post(ctx, errorResponse(c, err.Error()), h.username, h.token)
+		e.Result = auditFailed + ": " + err.Error()
+		h.audit.record(e)
+		return
+	}
+	logger(ctx).Info("Unfroze branch", "branch", branch)
+
+	h.setBranchStatus(ctx, repo, branch, stateSuccess, "At your service.")
+	c.post(ctx, unfrozenResponse(c, branch), h.username, h.token)
+	e.Result = auditUnfrozen
+	h.audit.record(e)
+}
+
+// setBranchStatus sets the st-review status of the open PRs targeting the
+// branch, except those on hold which stay failed.
+func (h *handler) setBranchStatus(ctx context.Context, repo, branch string, state prState, description string) {
+	prs, err := openPRs(ctx, repo, branch, h.username, h.token)
+	if err != nil {
+		logger(ctx).Error("Listing open PRs", "branch", branch, "error", err)
+		return
+	}
+
+	held := make(map[int]bool)
+	for _, hold := range h.db.Holds(repo) {
+		held[hold.PR] = true
+	}
+	for _, p := range prs {
+		if held[p.Number] {
+			continue
+		}
+		p.setStatus(ctx, state, "st-review", description, h.username, h.token)
+	}
+}
+
+// frozenDescription is the status description for PRs to a frozen branch.
+func frozenDescription(f freeze) string {
+	if f.Reason != "" {
+		return "Branch frozen: " + f.Reason
+	}
+	return "Branch frozen."
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFreeze(t *testing.T) {
+	os.RemoveAll("_db")
+	defer os.RemoveAll("_db")
+	db, err := OpenDB("_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A fake GitHub with two open PRs to main, recording the statuses and
+	// comments we post.
+	var statuses, comments []string
+	gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/repos/a/b/pulls" && r.URL.Query().Get("base") == "main":
+			base := "http://" + r.Host + "/repos/a/b/statuses/"
+			json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"number": 1, "statuses_url": base + "sha1"},
+				{"number": 2, "statuses_url": base + "sha2"},
+			})
+		case r.Method == "POST":
+			bs, _ := ioutil.ReadAll(r.Body)
+			var v map[string]string
+			json.Unmarshal(bs, &v)
+			if v["context"] != "" {
+				statuses = append(statuses, r.URL.Path+" "+v["state"]+" "+v["description"])
+			} else {
+				comments = append(comments, v["body"])
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer gh.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = gh.URL
+
+	audit, _ := newAuditLog(db, "")
+	h := newHandler([]string{"jb"}, "mergebot", "token", false, db, "", "", messageFromCommit, authorsIgnore, nil, newPermCache(time.Minute, time.Minute), newProtectionCache(time.Minute), audit, nil)
+	db.Hold(hold{Repo: "a/b", PR: 2, Sender: "ab", Time: time.Now()})
+
+	h.handleFreeze(context.Background(), newComment("a/b", 3, "jb", "@mergebot freeze main Release in progress"))
+	f, ok := db.Frozen("a/b", "main")
+	if !ok || f.Sender != "jb" || f.Reason != "Release in progress" {
+		t.Errorf("Unexpected freeze %+v", f)
+	}
+	expected := []string{"/repos/a/b/statuses/sha1 failure Branch frozen: Release in progress"}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("%v != %v", statuses, expected)
+	}
+
+	// Merges to the frozen branch are refused.
+	var p pr
+	p.Base.Ref = "main"
+	e := auditEntry{}
+	if !h.refuseFrozen(context.Background(), newComment("a/b", 1, "jb", "@mergebot merge"), p, &e) || e.Result != auditRefused+": branch frozen" {
+		t.Errorf("Merge not refused: %+v", e)
+	}
+	p.Base.Ref = "release"
+	if h.refuseFrozen(context.Background(), newComment("a/b", 1, "jb", "@mergebot merge"), p, &e) {
+		t.Error("Merge to other branch refused")
+	}
+
+	// Releasing a hold keeps the PR failing while the branch is frozen.
+	statuses = nil
+	var held pr
+	held.Number = 2
+	held.Repository.FullName = "a/b"
+	held.Repository.StatusesURL = gh.URL + "/repos/a/b/statuses/{sha}"
+	held.PullRequest.Head.SHA = "sha2"
+	held.PullRequest.Base.Ref = "main"
+	h.releaseHold(context.Background(), held, "Closed.")
+	expected = []string{"/repos/a/b/statuses/sha2 failure Branch frozen: Release in progress"}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("%v != %v", statuses, expected)
+	}
+	if holds := db.Holds("a/b"); len(holds) != 0 {
+		t.Errorf("Hold not released: %+v", holds)
+	}
+	db.Hold(hold{Repo: "a/b", PR: 2, Sender: "ab", Time: time.Now()})
+
+	statuses = nil
+	h.handleUnfreeze(context.Background(), newComment("a/b", 3, "jb", "@mergebot unfreeze main"))
+	if _, ok := db.Frozen("a/b", "main"); ok {
+		t.Error("Still frozen")
+	}
+	expected = []string{"/repos/a/b/statuses/sha1 success At your service."}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("%v != %v", statuses, expected)
+	}
+
+	h.handleUnfreeze(context.Background(), newComment("a/b", 3, "jb", "@mergebot unfreeze main"))
+	h.handleFreeze(context.Background(), newComment("a/b", 3, "jb", "@mergebot freeze"))
+	if len(comments) != 5 {
+		t.Errorf("Unexpected comments %q", comments)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+var githubAPIURL = "https://api.github.com" // overridden in tests
+
+var errNotFound = errors.New("not found")
+var errForbidden = errors.New("forbidden")
+
+func githubRequest(ctx context.Context, method, url string, body *bytes.Buffer, username, token string) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(username, token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// githubGet decodes the JSON response from the given URL into v. A 404
+// response is returned as errNotFound, as GitHub uses it to answer "no"
+// to questions like whether someone is a member of a team, and a 403 as
+// errForbidden.
+func githubGet(ctx context.Context, url, username, token string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(username, token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return errForbidden
+	}
+	if resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -13,11 +14,11 @@ import (
 )
 
 const (
-	maxWaitTime           = 30 * time.Minute
-	pollStepIncrease      = 5 * time.Second
 	lgtmsRequiredForMerge = 2
 )
 
+var errAlreadyPending = errors.New("merge already pending")
+
 // The handler receives commands from the webhook
 type handler struct {
 	token       string
@@ -25,48 +26,107 @@ type handler struct {
 	allowed     []string
 	teamAllowed []string
 	stop        chan struct{}
-	pending     map[int]struct{}
+	stopping    bool
+	stopMut     sync.Mutex
+	merging     sync.WaitGroup
+	waiting     sync.WaitGroup
+	pending     *pendingMerges
 	mut         sync.Mutex
 	branches    bool
 	db          *db
 	authorsfile string
 	mergedLabel string
+	msgSource   string
+	authorsMode string
+	audit       *auditLog
+	defaultCI   *ciConfig
+	protection  *protectionCache
 	permissions
 }
 
-func newHandler(allowed []string, username, token string, branches bool, db *db, authorsfile, mergedLabel string) *handler {
+func newHandler(allowed []string, username, token string, branches bool, db *db, authorsfile, mergedLabel, msgSource, authorsMode string, cfg *config, cache *permCache, protection *protectionCache, audit *auditLog, defaultCI *ciConfig) *handler {
 	return &handler{
 		username:    username,
 		token:       token,
 		allowed:     allowed,
 		stop:        make(chan struct{}),
-		pending:     make(map[int]struct{}),
+		pending:     newPendingMerges(),
 		branches:    branches,
 		db:          db,
 		authorsfile: authorsfile,
 		mergedLabel: mergedLabel,
+		msgSource:   msgSource,
+		authorsMode: authorsMode,
+		audit:       audit,
+		defaultCI:   defaultCI,
+		protection:  protection,
 		permissions: permissions{
+			username:      username,
 			token:         token,
 			alwaysAllowed: allowed,
-			teamMembers:   make(map[string][]string),
+			config:        cfg,
+			cache:         cache,
 		},
 	}
 }
 
-func (h *handler) handlePullReq(p pr) {
+// shutdown makes pending merges give up and waits for them to say so, and
+// for merges in progress to complete.
+func (h *handler) shutdown() {
+	h.stopMut.Lock()
+	if !h.stopping {
+		h.stopping = true
+		close(h.stop)
+	}
+	h.stopMut.Unlock()
+	h.waiting.Wait()
+	h.merging.Wait()
+}
+
+// background runs fn, which waits for something, in a goroutine that
+// shutdown waits for. When we're already shutting down fn runs right away
+// instead, to find that out and say so.
+func (h *handler) background(fn func()) {
+	h.stopMut.Lock()
+	if h.stopping {
+		h.stopMut.Unlock()
+		fn()
+		return
+	}
+	h.waiting.Add(1)
+	h.stopMut.Unlock()
+
+	go func() {
+		defer h.waiting.Done()
+		fn()
+	}()
+}
+
+// startMerge registers a merge in progress, unless we're shutting down.
+func (h *handler) startMerge() bool {
+	h.stopMut.Lock()
+	defer h.stopMut.Unlock()
+	if h.stopping {
+		return false
+	}
+	h.merging.Add(1)
+	return true
+}
+
+func (h *handler) handlePullReq(ctx context.Context, p pr) {
 	h.mut.Lock()
 	defer h.mut.Unlock()
 
 	if _, err := os.Stat(filepath.Join(p.Repository.FullName, ".git")); err != nil {
 		if err := clone(p.Repository.FullName); err != nil {
-			log.Println(err)
+			logger(ctx).Error("Clone failed", "error", err)
 			return
 		}
 	}
 
 	cur, err := os.Getwd()
 	if err != nil {
-		log.Println("No working dir?")
+		logger(ctx).Error("No working dir?", "error", err)
 		return
 	}
 
@@ -77,223 +137,652 @@ func (h *handler) handlePullReq(p pr) {
 		if h.branches {
 			updatePRBranch(p.Number)
 		}
-		p.setStatus(stateSuccess, "st-review", "At your service.", h.username, h.token)
+		h.releaseHold(ctx, p, "At your service.")
 	case "closed":
 		if h.branches {
 			deletePRBranch(p.Number)
 		}
-		p.setStatus(stateSuccess, "st-review", "Closed.", h.username, h.token)
+		h.releaseHold(ctx, p, "Closed.")
 	}
 
 	os.Chdir(cur)
 }
 
-func (h *handler) handleStop(c comment) {
+func (h *handler) handleStop(ctx context.Context, c comment) {
 	h.mut.Lock()
 	defer h.mut.Unlock()
 
-	if !h.isAllowed(c.Repository.FullName, c.Sender.Login) {
-		c.post(noAccessResponse(c), h.username, h.token)
-		log.Println("Rejecting request by unknown user", c.Sender.Login)
+	e := newAuditEntry(c)
+	if !h.isAllowed(ctx, c.Repository.FullName, "stop", c.Sender.Login) {
+		c.post(ctx, noAccessResponse(c), h.username, h.token)
+		logger(ctx).Info("Rejecting request by unknown user")
+		h.auditDenied(e)
 		return
 	}
 
-	pr, err := c.getPR()
+	h.placeHold(ctx, c, e)
+}
+
+// placeHold prevents the PR from being merged until it's updated.
+func (h *handler) placeHold(ctx context.Context, c comment, e auditEntry) error {
+	pr, err := c.getPR(ctx)
 	if err != nil {
-		log.Println("No pull request:", err)
+		logger(ctx).Error("No pull request", "error", err)
+		return err
+	}
+
+	pr.setStatus(ctx, stateFailure, "st-review", "Not to be merged as is.", h.username, h.token)
+	if err := h.db.Hold(hold{Repo: c.Repository.FullName, PR: c.Issue.Number, Sender: c.Sender.Login, Time: time.Now().UTC()}); err != nil {
+		logger(ctx).Error("Recording hold", "error", err)
+	}
+	c.post(ctx, notMergingResponse(c), h.username, h.token)
+	e.Result = auditStopped
+	h.audit.record(e)
+	return nil
+}
+
+// releaseHold removes any hold placed on the PR. The review status becomes
+// successful, unless the branch is frozen.
+func (h *handler) releaseHold(ctx context.Context, p pr, description string) {
+	h.db.Unhold(p.repo(), p.Number)
+	if f, ok := h.db.Frozen(p.repo(), p.baseRef()); ok {
+		p.setStatus(ctx, stateFailure, "st-review", frozenDescription(f), h.username, h.token)
+		return
+	}
+	p.setStatus(ctx, stateSuccess, "st-review", description, h.username, h.token)
+}
+
+func (h *handler) handleMerge(ctx context.Context, c comment) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	e := newAuditEntry(c)
+	if !h.isAllowed(ctx, c.Repository.FullName, "merge", c.Sender.Login) {
+		c.post(ctx, noAccessResponse(c), h.username, h.token)
+		logger(ctx).Info("Rejecting request by unknown user")
+		h.auditDenied(e)
+		return
+	}
+	if isMergeNow(c) && !h.isAllowed(ctx, c.Repository.FullName, "merge-now", c.Sender.Login) {
+		c.post(ctx, noAccessResponse(c), h.username, h.token)
+		logger(ctx).Info("Rejecting merge outside the merge window")
+		h.auditDenied(e)
 		return
 	}
 
-	pr.setStatus(stateFailure, "st-review", "Not to be merged as is.", h.username, h.token)
-	c.post(notMergingResponse(c), h.username, h.token)
+	h.merge(ctx, c, e)
 }
 
-func (h *handler) handleMerge(c comment) {
+// merge merges the PR, unless there is already a merge pending for it.
+func (h *handler) merge(ctx context.Context, c comment, e auditEntry) error {
+	if h.pending.has(c.Repository.FullName, c.Issue.Number) {
+		c.post(ctx, alreadyPendingResponse(c), h.username, h.token)
+		logger(ctx).Info("Rejecting request for already pending PR")
+		e.Result = auditRefused + ": already pending"
+		h.audit.record(e)
+		return errAlreadyPending
+	}
+
+	pr, err := c.getPR(ctx)
+	if err != nil {
+		logger(ctx).Error("No pull request", "error", err)
+		return err
+	}
+	if c.Issue.User.Login == "" {
+		// Not set when the command didn't come from GitHub.
+		c.Issue.User.Login = pr.User.Login
+	}
+
+	h.mergeWhenReady(ctx, c, pr, e)
+	return nil
+}
+
+func (h *handler) handleLGTM(ctx context.Context, c comment) {
 	h.mut.Lock()
 	defer h.mut.Unlock()
 
-	if !h.isAllowed(c.Repository.FullName, c.Sender.Login) {
-		c.post(noAccessResponse(c), h.username, h.token)
-		log.Println("Rejecting request by unknown user", c.Sender.Login)
+	e := newAuditEntry(c)
+	if !h.isAllowed(ctx, c.Repository.FullName, "lgtm", c.Sender.Login) {
+		c.post(ctx, noAccessResponse(c), h.username, h.token)
+		logger(ctx).Info("Rejecting request by unknown user")
+		h.auditDenied(e)
 		return
 	}
 
-	if _, ok := h.pending[c.Issue.Number]; ok {
-		c.post(alreadyPendingResponse(c), h.username, h.token)
-		log.Println("Rejecting request for already pending PR")
+	h.db.LGTM(c.Repository.FullName, c.Issue.Number, c.Sender.Login)
+	lgtms := h.db.LGTMs(c.Repository.FullName, c.Issue.Number)
+
+	if len(lgtms) < lgtmsRequiredForMerge {
+		c.post(ctx, lgtmResponse(c), h.username, h.token)
+		e.Result = auditNoted
+		h.audit.record(e)
 		return
 	}
 
-	pr, err := c.getPR()
+	pr, err := c.getPR(ctx)
 	if err != nil {
-		log.Println("No pull request:", err)
+		logger(ctx).Error("No pull request", "error", err)
+		return
+	}
+
+	h.mergeWhenReady(ctx, c, pr, e)
+}
+
+// mergeWhenReady merges the PR right away if the build status is good,
+// or waits for it to become good if it's pending. Outside the merge
+// window the merge is scheduled for when the window opens.
+func (h *handler) mergeWhenReady(ctx context.Context, c comment, pr pr, e auditEntry) {
+	if closed, reason, next := h.mergeWindowClosed(c); closed {
+		h.scheduleMerge(ctx, c, e, reason, next)
 		return
 	}
 
 	skip := fieldValues(c.Comment.Body, "Skip-Check")
-	statuses := pr.getStatuses(h.username, h.token)
-	required := pr.getRequiredStatuses(h.username, h.token)
+	statuses := pr.getStatuses(ctx, h.username, h.token)
+	required := h.requiredContexts(ctx, pr)
 	status := overallStatus(statuses, skip, required)
+	e.setStatus(status, statuses)
 
 	switch status {
 	case stateSuccess:
-		h.performMerge(c, pr)
+		h.performMerge(ctx, c, pr, e)
 
 	case statePending:
-		c.post(waitingResponse(c), h.username, h.token)
-		h.pending[c.Issue.Number] = struct{}{}
-		go h.delayedMerge(c, pr)
+		now := time.Now()
+		pm := pendingMerge{
+			Repo:      c.Repository.FullName,
+			PR:        c.Issue.Number,
+			Requester: c.Sender.Login,
+			Since:     now,
+			Deadline:  now.Add(h.waitPolicy(ctx, c).timeout),
+			Status:    status,
+			Statuses:  statuses,
+		}
+		p := h.pending.add(pm)
+		if p == nil {
+			c.post(ctx, alreadyPendingResponse(c), h.username, h.token)
+			e.Result = auditRefused + ": already pending"
+			h.audit.record(e)
+			return
+		}
+		c.post(ctx, waitingResponse(c, pm.Deadline), h.username, h.token)
+		e.Result = auditPending
+		h.audit.record(e)
+		h.background(func() { h.delayedMerge(ctx, c, pr, e, p) })
 
 	default:
-		c.post(badBuildResponse(c, status), h.username, h.token)
+		c.post(ctx, badBuildResponse(c, status), h.username, h.token)
+		e.Result = auditRefused + ": build status"
+		h.audit.record(e)
 	}
 }
 
-func (h *handler) handleLGTM(c comment) {
-	h.mut.Lock()
-	defer h.mut.Unlock()
-
-	if !h.isAllowed(c.Repository.FullName, c.Sender.Login) {
-		c.post(noAccessResponse(c), h.username, h.token)
-		log.Println("Rejecting request by unknown user", c.Sender.Login)
-		return
+// mergeWindowClosed returns true if merges to the repository must wait
+// for the merge window to open, why, and when it opens. The time is zero
+// if it doesn't open in the foreseeable future. "merge now" ignores the
+// merge window.
+func (h *handler) mergeWindowClosed(c comment) (bool, string, time.Time) {
+	if isMergeNow(c) {
+		return false, "", time.Time{}
+	}
+	sc := h.config.repo(c.Repository.FullName).Schedule
+	if sc == nil {
+		return false, "", time.Time{}
+	}
+	sched, err := newSchedule(sc)
+	if err != nil {
+		// Validated when the config is loaded
+		return false, "", time.Time{}
+	}
+	now := time.Now()
+	if ok, reason := sched.open(now); !ok {
+		return true, reason, sched.nextOpen(now).In(sched.loc)
 	}
+	return false, "", time.Time{}
+}
 
-	h.db.LGTM(c.Issue.Number, c.Sender.Login)
-	lgtms := h.db.LGTMs(c.Issue.Number)
+// isMergeNow returns true for "merge now" and "squash now".
+func isMergeNow(c comment) bool {
+	fields := strings.Fields(c.parseBody().command)
+	return len(fields) > 1 && strings.EqualFold(fields[1], "now")
+}
 
-	if len(lgtms) < lgtmsRequiredForMerge {
-		c.post(lgtmResponse(c), h.username, h.token)
+// scheduleMerge waits for the merge window to open and then merges the PR
+// as if asked to right then.
+func (h *handler) scheduleMerge(ctx context.Context, c comment, e auditEntry, reason string, next time.Time) {
+	if next.IsZero() {
+		c.post(ctx, mergeWindowClosedResponse(c, reason), h.username, h.token)
+		e.Result = auditRefused + ": " + reason
+		h.audit.record(e)
 		return
 	}
 
-	pr, err := c.getPR()
-	if err != nil {
-		log.Println("No pull request:", err)
+	pm := h.pending.add(pendingMerge{
+		Repo:      c.Repository.FullName,
+		PR:        c.Issue.Number,
+		Requester: c.Sender.Login,
+		Since:     time.Now(),
+		Status:    statePending,
+		Scheduled: next,
+	})
+	if pm == nil {
+		c.post(ctx, alreadyPendingResponse(c), h.username, h.token)
+		e.Result = auditRefused + ": already pending"
+		h.audit.record(e)
 		return
 	}
+	c.post(ctx, scheduledResponse(c, reason, next), h.username, h.token)
+	e.Result = auditScheduled
+	h.audit.record(e)
+	logger(ctx).Info("Scheduled merge", "reason", reason, "at", next)
+
+	h.background(func() {
+		defer h.pending.remove(pm)
+		for time.Now().Before(next) {
+			if !h.wait(ctx, c, e, pm, time.Until(next)) {
+				return
+			}
+		}
 
-	skip := fieldValues(c.Comment.Body, "Skip-Check")
-	statuses := pr.getStatuses(h.username, h.token)
-	required := pr.getRequiredStatuses(h.username, h.token)
-	status := overallStatus(statuses, skip, required)
+		h.mergeAfterWait(ctx, c, e, pm)
+	})
+}
 
-	switch status {
-	case stateSuccess:
-		h.performMerge(c, pr)
+// mergeAfterWait merges the PR as if asked to right now. The PR may well
+// have changed while we waited, so we get it and check its status again.
+func (h *handler) mergeAfterWait(ctx context.Context, c comment, e auditEntry, pm *pendingMerge) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
 
-	case statePending:
-		c.post(waitingResponse(c), h.username, h.token)
-		h.pending[c.Issue.Number] = struct{}{}
-		go h.delayedMerge(c, pr)
+	pr, err := c.getPR(ctx)
+	if err != nil {
+		logger(ctx).Error("No pull request", "error", err)
+		return
+	}
+	h.pending.remove(pm)
+	e.Time = time.Now().UTC()
+	h.mergeWhenReady(ctx, c, pr, e)
+}
 
-	default:
-		c.post(badBuildResponse(c, status), h.username, h.token)
+// wait waits for the given time, or less if asked to recheck. It returns
+// false if the pending merge was cancelled or we're shutting down while
+// waiting, after saying so.
+func (h *handler) wait(ctx context.Context, c comment, e auditEntry, pm *pendingMerge, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-pm.recheck:
+		return true
+	case <-pm.cancel:
+		c.post(ctx, cancelledResponse(c), h.username, h.token)
+		e.Result = auditCancelled
+		h.audit.record(e)
+		return false
+	case <-h.stop:
+		c.post(ctx, shutdownResponse(c), h.username, h.token)
+		e.Result = auditFailed + ": shutting down"
+		h.audit.record(e)
+		return false
 	}
 }
 
-func (h *handler) delayedMerge(c comment, pr pr) {
-	defer func() {
-		h.mut.Lock()
-		delete(h.pending, c.Issue.Number)
-		h.mut.Unlock()
-	}()
+func (h *handler) delayedMerge(ctx context.Context, c comment, pr pr, e auditEntry, pm *pendingMerge) {
+	defer h.pending.remove(pm)
 
 	t0 := time.Now()
-	wait := time.Second
+	policy := h.waitPolicy(ctx, c)
+	wait := policy.interval
 
 	skip := fieldValues(c.Comment.Body, "Skip-Check")
+	retries := newFlakyRetries(h.ciConfig(c.Repository.FullName))
 
-	for time.Since(t0) < maxWaitTime {
-		time.Sleep(wait)
+	for time.Now().Before(pm.Deadline) {
+		if left := time.Until(pm.Deadline); wait > left {
+			wait = left
+		}
+		if !h.wait(ctx, c, e, pm, jittered(wait)) {
+			return
+		}
+		if h.refuseFrozen(ctx, c, pr, &e) {
+			h.audit.record(e)
+			return
+		}
 
-		statuses := pr.getStatuses(h.username, h.token)
-		required := pr.getRequiredStatuses(h.username, h.token)
+		statuses := retries.mask(pr.getStatuses(ctx, h.username, h.token))
+		required := h.requiredContexts(ctx, pr)
 		status := overallStatus(statuses, skip, required)
+		if (status == stateError || status == stateFailure) && h.retryFlaky(ctx, pr, retries, statuses, skip, required) {
+			status = statePending
+			e.Retries = retries.counts
+		}
+		e.Time = time.Now().UTC()
+		e.setStatus(status, statuses)
+		h.pending.update(c.Repository.FullName, c.Issue.Number, status, statuses)
 
 		switch status {
 		case stateSuccess:
-			h.performMerge(c, pr)
+			observeSince(metricMergeWait, t0)
+			if closed, _, _ := h.mergeWindowClosed(c); !closed {
+				h.mut.Lock()
+				h.performMerge(ctx, c, pr, e)
+				h.mut.Unlock()
+				return
+			}
+			if h.waitForMergeWindow(ctx, c, e, pm) {
+				h.mergeAfterWait(ctx, c, e, pm)
+			}
 			return
 		case stateError, stateFailure:
-			c.post(badBuildResponse(c, status), h.username, h.token)
+			observeSince(metricMergeWait, t0)
+			c.post(ctx, badBuildResponse(c, status), h.username, h.token)
+			e.Result = auditRefused + ": build status"
+			h.audit.record(e)
 			return
 		}
 
-		wait += pollStepIncrease
+		wait = policy.next(wait)
+	}
+
+	observeSince(metricMergeWait, t0)
+	c.post(ctx, timeoutResponse(c, pm.Deadline.Sub(pm.Since).Round(time.Second)), h.username, h.token)
+	e.Result = auditTimeout
+	h.audit.record(e)
+}
+
+// waitForMergeWindow waits for the merge window to open, if it's closed.
+// It returns false if the merge should not go ahead, after saying so.
+func (h *handler) waitForMergeWindow(ctx context.Context, c comment, e auditEntry, pm *pendingMerge) bool {
+	for {
+		closed, reason, next := h.mergeWindowClosed(c)
+		if !closed {
+			return true
+		}
+		if next.IsZero() {
+			c.post(ctx, mergeWindowClosedResponse(c, reason), h.username, h.token)
+			e.Result = auditRefused + ": " + reason
+			h.audit.record(e)
+			return false
+		}
+
+		h.pending.schedule(pm, next)
+		c.post(ctx, scheduledResponse(c, reason, next), h.username, h.token)
+		for time.Now().Before(next) {
+			if !h.wait(ctx, c, e, pm, time.Until(next)) {
+				return false
+			}
+		}
+	}
+}
+
+// refuseFrozen returns true if the branch the PR targets is frozen, after
+// saying so.
+func (h *handler) refuseFrozen(ctx context.Context, c comment, pr pr, e *auditEntry) bool {
+	f, ok := h.db.Frozen(c.Repository.FullName, pr.baseRef())
+	if !ok {
+		return false
+	}
+	c.post(ctx, branchFrozenResponse(c, f), h.username, h.token)
+	e.Result = auditRefused + ": branch frozen"
+	logger(ctx).Info("Refusing merge to frozen branch", "branch", f.Branch)
+	return true
+}
+
+// retryFlaky retriggers the failed flaky checks, if retrying them could
+// make the build status good. It returns true if it did so.
+func (h *handler) retryFlaky(ctx context.Context, pr pr, retries *flakyRetries, statuses []status, skip, required []string) bool {
+	retry := retries.retryable(statuses)
+	if len(retry) == 0 {
+		return false
+	}
+	if s := overallStatus(withPending(statuses, retry), skip, required); s == stateError || s == stateFailure {
+		// Something else failed as well
+		return false
 	}
 
-	c.post(timeoutResponse(c, maxWaitTime), h.username, h.token)
+	cc := h.ciConfig(pr.repo())
+	jobs, _ := cc.jobsFor(retry)
+	if _, err := newCITrigger(*cc, h.username, h.token).TriggerBuild(ctx, pr, jobs); err != nil {
+		logger(ctx).Warn("Retrying flaky checks", "contexts", retry, "error", err)
+		return false
+	}
+	logger(ctx).Info("Retrying flaky checks", "contexts", retry, "jobs", jobs)
+	retries.retried(statuses, retry)
+	return true
 }
 
-func (h *handler) performMerge(c comment, pr pr) {
-	log.Printf("Attemping merge of PR %d on %s for %s", c.Issue.Number, c.Repository.FullName, c.Sender.Login)
+// committer returns the user to commit the merge as, from GitHub or, when
+// that doesn't give us an email address, from AUTHORS.
+func (h *handler) committer(ctx context.Context, c comment, authors []author) (user, error) {
+	u, err := c.user(ctx, h.username, h.token)
+	if err == nil && u.Email != "" {
+		return u, nil
+	}
+
+	u, ok := findAuthor(authors, h.username)
+	if ok {
+		err = nil
+	} else {
+		err = errors.New("not found")
+	}
+	logger(ctx).Info("Looked up user info in AUTHORS", "user", u, "error", err)
+	return u, err
+}
+
+func (h *handler) performMerge(ctx context.Context, c comment, pr pr, e auditEntry) {
+	e.Result = auditFailed
+	defer func() { h.audit.record(e) }()
+
+	if !h.startMerge() {
+		c.post(ctx, shutdownResponse(c), h.username, h.token)
+		e.Result = auditFailed + ": shutting down"
+		return
+	}
+	defer h.merging.Done()
+	defer observeSince(metricMergeDuration, time.Now())
+
+	if h.refuseFrozen(ctx, c, pr, &e) {
+		return
+	}
+	if h.refuseUnreviewed(ctx, c, pr, &e) {
+		return
+	}
+
+	logger(ctx).Info("Attempting merge")
 
 	if _, err := os.Stat(filepath.Join(c.Repository.FullName, ".git")); err != nil {
 		if err := clone(c.Repository.FullName); err != nil {
-			log.Println(err)
-			c.post(cloneFailedResponse(c, err.Error()), h.username, h.token)
+			logger(ctx).Error("Clone failed", "error", err)
+			c.post(ctx, cloneFailedResponse(c, err.Error()), h.username, h.token)
 			return
 		}
 	}
 
 	cur, err := os.Getwd()
 	if err != nil {
-		log.Println("No working dir?")
+		logger(ctx).Error("No working dir?", "error", err)
 		return
 	}
 
-	overrideDescr := ""
 	body := c.parseBody()
+	overrideDescr := overrideMessage(body.subject, body.description)
 
-	if body.subject != "" {
-		overrideDescr = strings.TrimSpace(body.subject + "\n\n" + reflow(body.description, 76))
+	// The AUTHORS file in the repository itself is authoritative, with the
+	// configured one as fallback for repositories that don't have one.
+	os.Chdir(c.Repository.FullName)
+	authors, err := readRepoAuthorsFile(pr.Base.Ref)
+	os.Chdir(cur)
+	if err != nil && !isLineErrors(err) {
+		logger(ctx).Warn("Reading AUTHORS from repository", "error", err)
+		authors, err = readAuthorsFile(h.authorsfile)
 	}
-
-	user, err := c.user(h.username, h.token)
-	if err != nil || user.Email == "" {
-		user, err = getUserFromFile(h.username, h.authorsfile)
-		log.Printf("Looked up user info in file: %#v, %v", user, err)
+	if err != nil && h.authorsfile != "" {
+		logger(ctx).Warn("Reading authors file", "error", err)
 	}
+
+	user, err := h.committer(ctx, c, authors)
 	if err != nil || user.Email == "" {
-		c.post(noUserResponse(c), h.username, h.token)
-		log.Printf("Failed merge of PR %d on %s for %s: no user info (%v)", c.Issue.Number, c.Repository.FullName, c.Sender.Login, err)
+		c.post(ctx, noUserResponse(c), h.username, h.token)
+		logger(ctx).Error("Failed merge: no user info", "error", err)
 		return
 	}
 
+	opts := squashOptions{
+		committer:   user,
+		message:     overrideDescr,
+		msgSource:   h.msgSource,
+		lgtm:        h.db.LGTMs(c.Repository.FullName, c.Issue.Number),
+		authors:     authors,
+		authorsMode: h.authorsMode,
+	}
+
 	os.Chdir(c.Repository.FullName)
-	sha1, err := squash(pr, user, overrideDescr, h.db.LGTMs(c.Issue.Number))
+	sha1, fixes, err := squash(ctx, pr, opts)
 	os.Chdir(cur)
 
+	if merr, ok := err.(*missingAuthorError); ok {
+		e.Result = auditRefused + ": missing from AUTHORS"
+		c.post(ctx, missingAuthorResponse(c, merr), h.username, h.token)
+		logger(ctx).Info("Refused merge", "error", err)
+		return
+	}
 	if err != nil {
-		c.post(errorResponse(c, err.Error()), h.username, h.token)
-		log.Printf("Failed merge of PR %d on %s for %s:\n%s", c.Issue.Number, c.Repository.FullName, c.Sender.Login, err.Error())
+		c.post(ctx, errorResponse(c, err.Error()), h.username, h.token)
+		logger(ctx).Error("Failed merge", "error", err)
 		return
 	}
 
-	c.post(thanksResponse(c, sha1), h.username, h.token)
+	e.Result = auditMerged
+	e.SHA = sha1
+	c.post(ctx, thanksResponse(c, sha1, e.Retries), h.username, h.token)
 	if h.mergedLabel != "" {
-		pr.setLabel(h.mergedLabel, h.username, h.token)
+		pr.setLabel(ctx, h.mergedLabel, h.username, h.token)
+	}
+	c.close(ctx, h.username, h.token)
+
+	// GitHub only closes issues on merges to the default branch, so we do
+	// the same.
+	if pr.Base.Repo.DefaultBranch == "" || pr.Base.Ref == pr.Base.Repo.DefaultBranch {
+		for _, ref := range fixes {
+			if !h.mayCloseIssue(ctx, c, ref) {
+				logger(ctx).Info("Not closing issue in other repository", "issue", ref.String(""), "requester", c.Sender.Login)
+				continue
+			}
+			if err := closeIssue(ctx, ref, fixedIssueResponse(c, sha1), h.username, h.token); err != nil {
+				logger(ctx).Error("Closing issue", "issue", ref.String(""), "error", err)
+			}
+		}
 	}
-	c.close(h.username, h.token)
-	log.Printf("Completed merge of PR %d on %s for %s", c.Issue.Number, c.Repository.FullName, c.Sender.Login)
+
+	logger(ctx).Info("Completed merge", "sha", sha1)
 }
 
-func (h *handler) handleBuild(c comment) {
-	pr, err := c.getPR()
+// mayCloseIssue returns true if we should close the referenced issue on
+// merge. The references come from the PR, so issues in other repositories
+// are only closed if whoever asked for the merge could close them.
+func (h *handler) mayCloseIssue(ctx context.Context, c comment, ref issueRef) bool {
+	if strings.EqualFold(ref.repo, c.Repository.FullName) {
+		return true
+	}
+	level, err := h.permissionLevel(ctx, ref.repo, c.Sender.Login)
 	if err != nil {
-		log.Println("No pull request:", err)
+		logger(ctx).Error("Checking permission level", "repo", ref.repo, "login", c.Sender.Login, "error", err)
+		return false
+	}
+	return permissionRank(level) >= permissionRank("write")
+}
+
+func (h *handler) handleBuild(ctx context.Context, c comment) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	e := newAuditEntry(c)
+	if !h.isAllowed(ctx, c.Repository.FullName, "rebuild", c.Sender.Login) {
+		c.post(ctx, noAccessResponse(c), h.username, h.token)
+		logger(ctx).Info("Rejecting request by unknown user")
+		h.auditDenied(e)
 		return
 	}
 
-	if err := tcTriggerBuild(pr.Number); err != nil {
-		c.post(tcErrorResponse(c, err), h.username, h.token)
+	pr, err := c.getPR(ctx)
+	if err != nil {
+		logger(ctx).Error("No pull request", "error", err)
+		return
+	}
+
+	cc := h.ciConfig(c.Repository.FullName)
+	if cc == nil {
+		c.post(ctx, noCIResponse(c), h.username, h.token)
+		e.Result = auditRefused + ": no CI configured"
+		h.audit.record(e)
+		return
 	}
+
+	// "rebuild" alone rebuilds everything, while "rebuild failed" or
+	// "rebuild <pattern>..." rebuilds the jobs behind the selected checks.
+	var jobs, rebuilding, unknown []string
+	if args := strings.Fields(c.parseBody().command)[1:]; len(args) > 0 {
+		statuses := pr.getStatuses(ctx, h.username, h.token)
+		contexts := selectContexts(statuses, cc.Contexts, args)
+		if len(contexts) == 0 {
+			c.post(ctx, nothingToRebuildResponse(c), h.username, h.token)
+			e.Result = auditRefused + ": nothing to rebuild"
+			h.audit.record(e)
+			return
+		}
+		jobs, unknown = cc.jobsFor(contexts)
+		if len(jobs) == 0 {
+			c.post(ctx, unknownContextsResponse(c, unknown), h.username, h.token)
+			e.Result = auditRefused + ": unknown contexts"
+			h.audit.record(e)
+			return
+		}
+		logger(ctx).Info("Rebuilding selected jobs", "contexts", contexts, "jobs", jobs)
+		for _, sc := range contexts {
+			if !stringset(unknown).contains(sc) {
+				rebuilding = append(rebuilding, sc)
+			}
+		}
+	}
+
+	e.Result = auditTrigger
+	builds, err := newCITrigger(*cc, h.username, h.token).TriggerBuild(ctx, pr, jobs)
+	switch {
+	case err != nil:
+		c.post(ctx, ciErrorResponse(c, builds, err), h.username, h.token)
+		e.Result = auditFailed + ": " + err.Error()
+	case len(builds) > 0 || len(rebuilding) > 0:
+		c.post(ctx, rebuildingResponse(c, rebuilding, unknown, builds), h.username, h.token)
+	}
+	h.audit.record(e)
+}
+
+// ciConfig returns the CI configuration for the repository, or nil if
+// there is none.
+func (h *handler) ciConfig(repo string) *ciConfig {
+	if cc := h.config.repo(repo).CI; cc != nil {
+		return cc
+	}
+	return h.defaultCI
+}
+
+func (h *handler) auditDenied(e auditEntry) {
+	e.Allowed = false
+	e.Result = auditDenied
+	h.audit.record(e)
 }
 
 var allowedCommitSubjectRe = regexp.MustCompile(`^[a-zA-Z0-9_./-]+:\s`)
 
-func squash(pr pr, user user, msg string, lgtm []string) (string, error) {
+type squashOptions struct {
+	committer   user
+	message     string // overrides msgSource when set
+	msgSource   string
+	lgtm        []string
+	authors     []author
+	authorsMode string // what to do about authors missing from AUTHORS
+}
+
+func squash(ctx context.Context, pr pr, opts squashOptions) (string, []issueRef, error) {
 	sourceBranch := fmt.Sprintf("pr-%d", pr.Number)
 	dstBranch := pr.Base.Ref
 
@@ -311,40 +800,113 @@ func squash(pr pr, user user, msg string, lgtm []string) (string, error) {
 	mergeBase := t.run("git", "merge-base", sourceBranch, dstBranch)
 	revs := strings.Fields(t.run("git", "rev-list", mergeBase+".."+sourceBranch))
 	if len(revs) == 0 {
-		return "", fmt.Errorf("Nothing to merge, as far as I can tell.")
+		return "", nil, fmt.Errorf("Nothing to merge, as far as I can tell.")
 	}
 	firstCommit := revs[len(revs)-1]
 	authorName := t.run("git", "log", "-n1", "--pretty=format:%an", firstCommit)
 	authorEmail := t.run("git", "log", "-n1", "--pretty=format:%ae", firstCommit)
-	os.Setenv("GIT_COMMITTER_NAME", user.Name)
-	os.Setenv("GIT_COMMITTER_EMAIL", user.Email)
+
+	// Canonicalize the author according to the repository mailmap
+	mm, err := readMailmap(".mailmap")
+	if err != nil && !os.IsNotExist(err) {
+		logger(ctx).Warn("Reading .mailmap", "error", err)
+	}
+	authorName, authorEmail = mm.lookup(authorName, authorEmail)
+
+	os.Setenv("GIT_COMMITTER_NAME", opts.committer.Name)
+	os.Setenv("GIT_COMMITTER_EMAIL", opts.committer.Email)
 	os.Setenv("GIT_AUTHOR_NAME", authorName)
 	os.Setenv("GIT_AUTHOR_EMAIL", authorEmail)
 
 	var body string
-	if msg != "" {
+	switch {
+	case opts.message != "":
 		// Overridden commit message from parameters
-		body = msg
-	} else {
+		body = opts.message
+	case opts.msgSource == messageFromPR && pr.Title != "":
+		// Commit message from the PR title and description
+		body = prMessage(pr.Title, pr.Body)
+	case opts.msgSource == messageFromSubjects && pr.Title != "":
+		// Commit message from the PR title and all commit subjects
+		subjects := t.run("git", "log", "--reverse", "--pretty=format:%s", mergeBase+".."+sourceBranch)
+		body = subjectsMessage(pr.Title, strings.Split(subjects, "\n"))
+	default:
 		// Commit message from first commit
 		body = t.run("git", "log", "-n1", "--pretty=format:%B", firstCommit)
 	}
 
-	body = fmt.Sprintf("%s\n\nGitHub-Pull-Request: %s\n", strings.TrimSpace(body), pr.HTMLURL)
-	if len(lgtm) > 0 {
-		body = fmt.Sprintf("%sLGTM: %s\n", body, strings.Join(lgtm, ", "))
+	// Fields from all the commits in the PR, to carry over
+	commitMsgs := t.run("git", "log", "--pretty=format:%B", mergeBase+".."+sourceBranch)
+	commitFields := parseFields(commitMsgs)
+
+	// Issues closed by the PR description or any of the commits
+	fixes := closingRefs(pr.Body+"\n"+commitMsgs+"\n"+body, pr.Base.Repo.FullName)
+
+	// Everyone else who authored commits in the PR, or was credited as a
+	// co-author in them
+	idents := strings.Split(t.run("git", "log", "--pretty=format:%an <%ae>", mergeBase+".."+sourceBranch), "\n")
+	idents = append(idents, commitFields.values("Co-authored-by")...)
+	coAuthored := coAuthors(authorName+" <"+authorEmail+">", idents, opts.authors, mm)
+
+	text, trailers := parseTrailers(body)
+	trailers = trailers.remove("Timeout") // for us, not for the history
+	trailers = trailers.add("GitHub-Pull-Request", pr.HTMLURL)
+	for _, ref := range fixes {
+		trailers = trailers.add("Fixes", ref.String(pr.Base.Repo.FullName))
+	}
+	if len(opts.lgtm) > 0 {
+		trailers = trailers.add("LGTM", strings.Join(opts.lgtm, ", "))
+	}
+	for _, login := range opts.lgtm {
+		for _, u := range opts.authors {
+			if u.Login == login && u.Email != "" {
+				trailers = trailers.add("Reviewed-by", fmt.Sprintf("%s <%s>", u.Name, u.Email))
+			}
+		}
+	}
+	for _, ident := range coAuthored {
+		trailers = trailers.add("Co-authored-by", ident)
+	}
+	for _, signoff := range commitFields.values("Signed-off-by") {
+		trailers = trailers.add("Signed-off-by", signoff)
 	}
+	body = withTrailers(text, trailers)
 
 	s.run("git", "merge", "--squash", "--no-commit", sourceBranch)
+
+	// Check that the author is listed in the AUTHORS file of the
+	// repository, if it has one, as it looks with the PR merged; the PR
+	// may well add the author itself.
+	if opts.authorsMode != authorsIgnore && s.Error() == nil {
+		login := authorLogin(authorEmail, pr.User.Login, opts.authors)
+		listed, err := authorsFileLists("AUTHORS", authorEmail)
+		switch {
+		case err != nil && !os.IsNotExist(err):
+			s.run("git", "reset", "--hard")
+			return "", nil, err
+		case err != nil || listed:
+			// No AUTHORS file, or all is well
+		case opts.authorsMode == authorsRefuse:
+			s.run("git", "reset", "--hard")
+			return "", nil, &missingAuthorError{name: authorName, email: authorEmail, login: login}
+		case opts.authorsMode == authorsAdd:
+			entry := user{Login: login, Name: authorName, Email: authorEmail}
+			if err := appendAuthorsFile("AUTHORS", entry); err != nil {
+				s.run("git", "reset", "--hard")
+				return "", nil, err
+			}
+			s.run("git", "add", "AUTHORS")
+		}
+	}
 	s.runPipe(bytes.NewBufferString(body), "git", "commit", "-F", "-")
 	sha1 := s.run("git", "rev-parse", "HEAD")
 	s.run("git", "push", "origin", dstBranch)
 
 	if s.Error() != nil {
 		// Overwrite the error with whatever actual output we had, as a markdown verbatim.
-		return "", fmt.Errorf("%s", s.output.String())
+		return "", nil, fmt.Errorf("%s", s.output.String())
 	}
-	return sha1, nil
+	return sha1, fixes, nil
 }
 
 func updatePRBranch(pr int) {
@@ -358,6 +920,19 @@ func deletePRBranch(pr int) {
 	s.run("git", "push", "origin", fmt.Sprintf(":pr-%d", pr))
 }
 
+// reclone replaces our clone of the repository with a fresh one. Merges
+// hold the lock while working in the clone, so we never pull it out from
+// under one.
+func (h *handler) reclone(repo string) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	if err := os.RemoveAll(repo); err != nil {
+		return err
+	}
+	return clone(repo)
+}
+
 func clone(repo string) error {
 	s := newScript()
 	s.run("git", "clone", fmt.Sprintf("https://github.com/%s.git", repo), repo)
@@ -367,23 +942,17 @@ func clone(repo string) error {
 	return nil
 }
 
-func fieldValues(message, field string) []string {
-	var res []string
-	field = strings.ToLower(field)
-	for _, line := range strings.Split(message, "\n") {
-		fields := strings.Fields(line)
-		if len(fields) < 2 {
-			continue
-		}
-		if strings.ToLower(fields[0]) == field+":" {
-			res = append(res, fields[1:]...)
+type stringset []string
+
+func (s stringset) contains(item string) bool {
+	for _, v := range s {
+		if item == v {
+			return true
 		}
 	}
-	return res
+	return false
 }
 
-type stringset []string
-
 func (s stringset) add(item string) stringset {
 	for _, v := range s {
 		if item == v {
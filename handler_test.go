@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestFieldValues(t *testing.T) {
@@ -24,3 +28,51 @@ func TestFieldValues(t *testing.T) {
 		}
 	}
 }
+
+func TestCommitterFromAuthors(t *testing.T) {
+	// GitHub is unreachable
+	gh := httptest.NewServer(http.NotFoundHandler())
+	gh.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = gh.URL
+
+	h := &handler{username: "mergebot", token: "token"}
+	c := newComment("a/b", 1, "jb", "@mergebot merge")
+	authors := []author{{user: user{Login: "mergebot", Name: "Merge Bot", Email: "bot@example.com"}}}
+
+	u, err := h.committer(context.Background(), c, authors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "bot@example.com" {
+		t.Errorf("Unexpected committer %+v", u)
+	}
+
+	if _, err := h.committer(context.Background(), c, nil); err == nil {
+		t.Error("Unexpected nil error without AUTHORS entry")
+	}
+}
+
+func TestShutdownWaitsForBackground(t *testing.T) {
+	h := &handler{stop: make(chan struct{})}
+
+	done := make(chan struct{})
+	h.background(func() {
+		<-h.stop
+		time.Sleep(10 * time.Millisecond) // say we're giving up
+		close(done)
+	})
+	h.shutdown()
+	select {
+	case <-done:
+	default:
+		t.Error("Shutdown didn't wait for the background goroutine")
+	}
+
+	// Once shutting down, it runs right away
+	ran := false
+	h.background(func() { ran = true })
+	if !ran {
+		t.Error("Background function didn't run")
+	}
+}
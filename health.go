@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A readinessCheck returns an error when some prerequisite for handling
+// webhooks is not in place.
+type readinessCheck func(ctx context.Context) error
+
+// handleHealthz answers that the process is alive.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readinessHandler runs all the checks and answers 503 Service
+// Unavailable, listing the failures, unless they all pass.
+func readinessHandler(checks map[string]readinessCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var names []string
+		for name := range checks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var failed []string
+		for _, name := range names {
+			if err := checks[name](r.Context()); err != nil {
+				logger(r.Context()).Warn("Readiness check failed", "check", name, "error", err)
+				failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+
+		if len(failed) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			for _, f := range failed {
+				fmt.Fprintln(w, f)
+			}
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// githubTokenCheck returns a check that the GitHub token is accepted.
+// Successful checks are remembered for a while, to not spend the rate
+// limit on load balancer probes.
+func githubTokenCheck(username, token string, cacheFor time.Duration) readinessCheck {
+	var mut sync.Mutex
+	var okUntil time.Time
+	return func(ctx context.Context) error {
+		mut.Lock()
+		defer mut.Unlock()
+		if time.Now().Before(okUntil) {
+			return nil
+		}
+
+		var u struct {
+			Login string
+		}
+		if err := githubGet(ctx, githubAPIURL+"/user", username, token, &u); err != nil {
+			return err
+		}
+		okUntil = time.Now().Add(cacheFor)
+		return nil
+	}
+}
+
+// writableDirCheck returns a check that files can be created in the
+// given directory, where repositories are cloned.
+func writableDirCheck(dir string) readinessCheck {
+	return func(ctx context.Context) error {
+		fd, err := ioutil.TempFile(dir, ".mergebot-ready-")
+		if err != nil {
+			return err
+		}
+		fd.Close()
+		return os.Remove(fd.Name())
+	}
+}
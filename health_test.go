@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	failing := false
+	checks := map[string]readinessCheck{
+		"always": func(context.Context) error { return nil },
+		"sometimes": func(context.Context) error {
+			if failing {
+				return errors.New("nope")
+			}
+			return nil
+		},
+	}
+
+	rec := httptest.NewRecorder()
+	readinessHandler(checks)(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d", rec.Code)
+	}
+
+	failing = true
+	rec = httptest.NewRecorder()
+	readinessHandler(checks)(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != "sometimes: nope\n" {
+		t.Errorf("Unexpected body %q", body)
+	}
+}
+
+func TestGithubTokenCheck(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if _, pass, _ := r.BasicAuth(); pass != "good" {
+			http.Error(w, "Bad credentials", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"login": "mergebot"}`))
+	}))
+	defer srv.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = srv.URL
+
+	if err := githubTokenCheck("mergebot", "bad", time.Minute)(context.Background()); err == nil {
+		t.Error("Unexpected nil error for bad token")
+	}
+
+	check := githubTokenCheck("mergebot", "good", time.Minute)
+	for i := 0; i < 3; i++ {
+		if err := check(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}
+	if requests != 2 {
+		t.Errorf("Expected the good result to be cached, got %d requests", requests)
+	}
+}
+
+func TestWritableDirCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mergebot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := writableDirCheck(dir)(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := writableDirCheck(dir + "/missing")(context.Background()); err == nil {
+		t.Error("Unexpected nil error for missing dir")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Left files behind: %v", files)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleHealthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "ok" {
+		t.Errorf("Unexpected response %d %q", rec.Code, rec.Body.String())
+	}
+}
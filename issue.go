@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The keywords GitHub recognizes for closing an issue from a pull request
+// or commit message, followed by an issue reference in one of the forms
+// #123, owner/repo#123 or https://github.com/owner/repo/issues/123.
+var closingRe = regexp.MustCompile(`(?i)\b(?:close[sd]?|fix(?:e[sd])?|resolve[sd]?):?\s+(?:([\w.-]+/[\w.-]+)?#(\d+)|https://github\.com/([\w.-]+/[\w.-]+)/issues/(\d+))\b`)
+
+// issueRef is a reference to an issue in a repository.
+type issueRef struct {
+	repo   string
+	number int
+}
+
+// String returns the reference in the short form used in trailers, i.e.
+// #123 for issues in the given repo and owner/repo#123 otherwise.
+func (r issueRef) String(repo string) string {
+	if r.repo == repo {
+		return fmt.Sprintf("#%d", r.number)
+	}
+	return fmt.Sprintf("%s#%d", r.repo, r.number)
+}
+
+// closingRefs returns the issues referenced with a closing keyword in the
+// given text. References without a repository are taken to be in repo.
+// Keywords in comments and code don't count, so that PR templates and
+// examples don't close issues.
+func closingRefs(text, repo string) []issueRef {
+	var res []issueRef
+	seen := make(map[issueRef]bool)
+	for _, m := range closingRe.FindAllStringSubmatch(withoutCode(text), -1) {
+		ref := issueRef{repo: m[1]}
+		num := m[2]
+		if m[4] != "" {
+			ref.repo, num = m[3], m[4]
+		}
+		if ref.repo == "" {
+			ref.repo = repo
+		}
+		ref.number, _ = strconv.Atoi(num)
+		if ref.number == 0 || seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		res = append(res, ref)
+	}
+	return res
+}
+
+// withoutCode returns the text without HTML comments, code blocks and
+// inline code.
+func withoutCode(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = htmlCommentRe.ReplaceAllString(s, "")
+
+	var lines []string
+	inCode := false
+	for _, line := range strings.Split(s, "\n") {
+		if codeFenceRe.MatchString(line) {
+			inCode = !inCode
+			continue
+		}
+		if inCode || strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		lines = append(lines, inlineCodeRe.ReplaceAllString(line, ""))
+	}
+	return strings.Join(lines, "\n")
+}
+
+type issue struct {
+	State       string
+	URL         string
+	CommentsURL string           `json:"comments_url"`
+	PullRequest *json.RawMessage `json:"pull_request"`
+}
+
+// closeIssue posts the given message to the referenced issue and closes
+// it. Pull requests and issues that are already closed are left alone.
+func closeIssue(ctx context.Context, ref issueRef, msg, username, token string) error {
+	url := fmt.Sprintf("%s/repos/%s/issues/%d", githubAPIURL, ref.repo, ref.number)
+	var iss issue
+	if err := githubGet(ctx, url, username, token, &iss); err != nil {
+		return err
+	}
+	if iss.State == "closed" || iss.PullRequest != nil {
+		logger(ctx).Info("Not closing issue", "issue", ref.String(""), "state", iss.State)
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	json.NewEncoder(buf).Encode(map[string]string{"body": msg})
+	if err := githubRequest(ctx, "POST", iss.CommentsURL, buf, username, token); err != nil {
+		return err
+	}
+
+	buf = new(bytes.Buffer)
+	json.NewEncoder(buf).Encode(map[string]string{"state": "closed"})
+	return githubRequest(ctx, "PATCH", iss.URL, buf, username, token)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClosingRefs(t *testing.T) {
+	cases := []struct {
+		text string
+		refs []issueRef
+	}{
+		{"Nothing to see here, see #12", nil},
+		{"This fixes #12.", []issueRef{{"a/b", 12}}},
+		{"Closes #12, resolves other/repo#3 and fixed #12", []issueRef{{"a/b", 12}, {"other/repo", 3}}},
+		{"Fixes: #12\nFixes: https://github.com/other/repo/issues/4", []issueRef{{"a/b", 12}, {"other/repo", 4}}},
+		{"FIXES #0", nil},
+		{"prefixes #12", nil},
+		{"<!-- Write \"Fixes #12\" to close an issue -->\nFixes #13", []issueRef{{"a/b", 13}}},
+		{"Example:\n\n```\nFixes #12\n```\n\nOr `fixes #14`, or\n\n    fixes #15\n", nil},
+	}
+
+	for _, tc := range cases {
+		refs := closingRefs(tc.text, "a/b")
+		if !reflect.DeepEqual(refs, tc.refs) {
+			t.Errorf("Got %v for %q, expected %v", refs, tc.text, tc.refs)
+		}
+	}
+}
+
+func TestIssueRefString(t *testing.T) {
+	if s := (issueRef{"a/b", 12}).String("a/b"); s != "#12" {
+		t.Errorf("Unexpected %q", s)
+	}
+	if s := (issueRef{"c/d", 12}).String("a/b"); s != "c/d#12" {
+		t.Errorf("Unexpected %q", s)
+	}
+}
+
+func TestMayCloseIssue(t *testing.T) {
+	gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/c/d/collaborators/jb/permission":
+			w.Write([]byte(`{"permission": "write"}`))
+		case "/repos/c/d/collaborators/ab/permission":
+			w.Write([]byte(`{"permission": "read"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer gh.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = gh.URL
+
+	h := newHandler(nil, "mergebot", "token", false, nil, "", "", messageFromCommit, authorsIgnore, nil, newPermCache(time.Minute, time.Minute), newProtectionCache(time.Minute), nil, nil)
+	cases := []struct {
+		sender string
+		ref    issueRef
+		ok     bool
+	}{
+		{"ab", issueRef{"a/b", 1}, true},
+		{"jb", issueRef{"c/d", 1}, true},
+		{"ab", issueRef{"c/d", 1}, false},
+		{"ab", issueRef{"e/f", 1}, false},
+	}
+	for _, tc := range cases {
+		if ok := h.mayCloseIssue(context.Background(), newComment("a/b", 1, tc.sender, "@mergebot merge"), tc.ref); ok != tc.ok {
+			t.Errorf("%s closing %v: %v != %v", tc.sender, tc.ref, ok, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The jenkinsTrigger starts parameterized Jenkins jobs, passing the PR
+// number and branch as the PR and BRANCH parameters.
+type jenkinsTrigger struct {
+	url   string
+	user  string
+	token string // API token
+	jobs  []string
+}
+
+func (t *jenkinsTrigger) TriggerBuild(ctx context.Context, p pr, jobs []string) ([]triggeredBuild, error) {
+	if len(jobs) == 0 {
+		jobs = t.jobs
+	}
+	params := url.Values{
+		"PR":     {fmt.Sprint(p.Number)},
+		"BRANCH": {fmt.Sprintf("pull/%d", p.Number)},
+	}
+	var errs triggerErrors
+	for _, job := range jobs {
+		errs = errs.add(job, t.build(ctx, job, params))
+	}
+	return nil, errs.err()
+}
+
+func (t *jenkinsTrigger) build(ctx context.Context, job string, params url.Values) error {
+	// Jobs in folders are given as folder/job and live at
+	// /job/folder/job/job.
+	var path strings.Builder
+	for _, part := range strings.Split(job, "/") {
+		path.WriteString("/job/" + url.PathEscape(part))
+	}
+
+	u := t.url + path.String() + "/buildWithParameters?" + params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(t.user, t.token)
+	return ciDo(req, nil)
+}
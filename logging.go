@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+type loggerKey struct{}
+
+// withLogFields returns a context carrying a logger that adds the given
+// fields to everything logged through it.
+func withLogFields(ctx context.Context, args ...interface{}) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger(ctx).With(args...))
+}
+
+// logger returns the logger for the context, or the default logger when
+// there isn't one.
+func logger(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// newLogger returns a logger writing to w in the given format (text, for
+// logfmt style output, or json) at the given minimum level.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{
+		AddSource:   true,
+		Level:       lvl,
+		ReplaceAttr: shortSource,
+	}
+
+	switch strings.ToLower(format) {
+	case "text", "logfmt":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// shortSource replaces the source location with just file:line, like
+// log.Lshortfile.
+func shortSource(groups []string, a slog.Attr) slog.Attr {
+	if a.Key != slog.SourceKey {
+		return a
+	}
+	if src, ok := a.Value.Any().(*slog.Source); ok {
+		a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+	}
+	return a
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func TestContextLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l, err := newLogger(buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), loggerKey{}, l)
+	ctx = withLogFields(ctx, "delivery", "abc", "repo", "a/b")
+	ctx = withLogFields(ctx, "pr", 12)
+	logger(ctx).Debug("not shown")
+	logger(ctx).Info("Handling comment", "command", "merge")
+	_, _, line, _ := runtime.Caller(0) // the line after the one logging
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	expected := map[string]interface{}{
+		"msg":      "Handling comment",
+		"level":    "INFO",
+		"delivery": "abc",
+		"repo":     "a/b",
+		"pr":       float64(12),
+		"command":  "merge",
+		"source":   fmt.Sprintf("logging_test.go:%d", line-1),
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("%s: got %v, expected %v", k, entry[k], v)
+		}
+	}
+}
+
+func TestNewLoggerErrors(t *testing.T) {
+	if _, err := newLogger(new(bytes.Buffer), "xml", "info"); err == nil {
+		t.Error("Unexpected nil error for bad format")
+	}
+	if _, err := newLogger(new(bytes.Buffer), "text", "loud"); err == nil {
+		t.Error("Unexpected nil error for bad level")
+	}
+}
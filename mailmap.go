@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// A mailmap maps commit identities to canonical ones, as described in
+// git-check-mailmap(1). Each entry is on one of the forms
+//
+//	Proper Name <commit@email>
+//	<proper@email> <commit@email>
+//	Proper Name <proper@email> <commit@email>
+//	Proper Name <proper@email> Commit Name <commit@email>
+type mailmap []mailmapEntry
+
+type mailmapEntry struct {
+	properName  string
+	properEmail string
+	commitName  string // empty matches any name
+	commitEmail string
+}
+
+// parseMailmap parses a .mailmap file. Blank lines and comments are
+// ignored. Malformed lines are skipped and reported in the returned error,
+// which is then of the lineErrors type.
+func parseMailmap(r io.Reader) (mailmap, error) {
+	var res mailmap
+	var errs lineErrors
+	sc := bufio.NewScanner(r)
+	lineNo := 0
+	for sc.Scan() {
+		lineNo++
+		line := sc.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		e, err := parseMailmapLine(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", lineNo, err))
+			continue
+		}
+		res = append(res, e)
+	}
+	if err := sc.Err(); err != nil {
+		return res, err
+	}
+	if len(errs) > 0 {
+		return res, errs
+	}
+	return res, nil
+}
+
+func parseMailmapLine(line string) (mailmapEntry, error) {
+	var e mailmapEntry
+
+	// Split off the commit identity, if there is one after the proper
+	// email address.
+	first := strings.Index(line, ">")
+	if first < 0 {
+		return e, fmt.Errorf("no email address")
+	}
+	proper, commit := line[:first+1], strings.TrimSpace(line[first+1:])
+
+	name, emails, err := splitEmails(proper)
+	if err != nil {
+		return e, err
+	}
+	if len(emails) == 0 {
+		return e, fmt.Errorf("no email address")
+	}
+	e.properName = name
+	e.properEmail = emails[0]
+
+	if commit == "" {
+		// "Proper Name <commit@email>"
+		if e.properName == "" {
+			return e, fmt.Errorf("nothing to map")
+		}
+		e.commitEmail, e.properEmail = e.properEmail, ""
+		return e, nil
+	}
+
+	name, emails, err = splitEmails(commit)
+	if err != nil {
+		return e, err
+	}
+	if len(emails) != 1 {
+		return e, fmt.Errorf("expected one commit email address, not %d", len(emails))
+	}
+	e.commitName = name
+	e.commitEmail = emails[0]
+	return e, nil
+}
+
+func readMailmap(file string) (mailmap, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return parseMailmap(fd)
+}
+
+// lookup returns the canonical name and email for the given commit
+// identity. Entries matching both name and email take precedence over
+// those matching the email only, and parts of the identity not given by
+// the matching entry are returned unchanged. Names and emails are
+// compared ignoring case, as git does.
+func (m mailmap) lookup(name, email string) (string, string) {
+	var match *mailmapEntry
+	for i, e := range m {
+		if !strings.EqualFold(e.commitEmail, email) {
+			continue
+		}
+		if strings.EqualFold(e.commitName, name) {
+			match = &m[i]
+			break
+		}
+		if e.commitName == "" && match == nil {
+			match = &m[i]
+		}
+	}
+	if match == nil {
+		return name, email
+	}
+	if match.properName != "" {
+		name = match.properName
+	}
+	if match.properEmail != "" {
+		email = match.properEmail
+	}
+	return name, email
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMailmap(t *testing.T) {
+	in := `# A comment
+Foo Bar <foo@example.com>
+<baz@example.com> <quux@example.com> # trailing comment
+Frob Banana <frob@example.com> <frobble@example.com>
+Frob Banana <frob@example.com> Frobby <frob@old.example.com>
+Other Person <other@example.com> Frobby <frob@old.example.com> <x>
+Just a name
+`
+
+	mm, err := parseMailmap(strings.NewReader(in))
+	if !isLineErrors(err) || !strings.HasPrefix(err.Error(), "line 6:") {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	cases := [][4]string{
+		// commit name, commit email, canonical name, canonical email
+		{"foo", "foo@example.com", "Foo Bar", "foo@example.com"},
+		{"Baz", "QUUX@example.com", "Baz", "baz@example.com"},
+		{"Frob", "frobble@example.com", "Frob Banana", "frob@example.com"},
+		{"Frobby", "frob@old.example.com", "Frob Banana", "frob@example.com"},
+		{"frobby", "FROB@old.example.com", "Frob Banana", "frob@example.com"},
+		{"Someone", "frob@old.example.com", "Someone", "frob@old.example.com"},
+		{"Unknown", "unknown@example.com", "Unknown", "unknown@example.com"},
+	}
+
+	for _, tc := range cases {
+		name, email := mm.lookup(tc[0], tc[1])
+		if name != tc[2] || email != tc[3] {
+			t.Errorf("%s <%s> mapped to %s <%s>, expected %s <%s>", tc[0], tc[1], name, email, tc[2], tc[3])
+		}
+	}
+}
+
+func FuzzParseMailmap(f *testing.F) {
+	f.Add("Foo Bar <foo@example.com>")
+	f.Add("<baz@example.com> <quux@example.com>")
+	f.Add("Frob Banana <frob@example.com> Frobby <frob@old.example.com>")
+	f.Add("a> <b")
+
+	f.Fuzz(func(t *testing.T, in string) {
+		mm, err := parseMailmap(strings.NewReader(in))
+		if err != nil && !isLineErrors(err) {
+			return
+		}
+		for _, e := range mm {
+			if e.commitEmail == "" {
+				t.Errorf("Entry without commit email %+v parsed from %q", e, in)
+			}
+		}
+	})
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/thejerf/suture"
 )
@@ -20,6 +25,21 @@ func main() {
 	dbfile := flag.String("dbfile", "mergebot.db", "Database file")
 	authorsfile := flag.String("authorsfile", "", "AUTHORS file")
 	mergedLabel := flag.String("merged-label", "", "Label to add when merging")
+	msgSource := flag.String("message", messageFromCommit, "Commit message source (commit, pr, subjects)")
+	authorsMode := flag.String("authors", authorsIgnore, "What to do about PR authors missing from the repository AUTHORS file (ignore, refuse, add)")
+	permCacheTTL := flag.Duration("perm-cache-ttl", 10*time.Minute, "How long to cache granted permissions")
+	permCacheNegativeTTL := flag.Duration("perm-cache-negative-ttl", 5*time.Minute, "How long to cache denied permissions")
+	protectionCacheTTL := flag.Duration("protection-cache-ttl", 10*time.Minute, "How long to cache branch protection requirements")
+	auditFile := flag.String("audit-log", "", "File to append the audit log to as JSON lines, in addition to the database")
+	adminAddr := flag.String("admin-listen", "", "Listen address for the admin API (disabled when empty)")
+	adminToken := flag.String("admin-token", "", "Bearer token required by the admin API")
+	logFormat := flag.String("log-format", "text", "Log format (text or json)")
+	logLevel := flag.String("log-level", "info", "Minimum log level (debug, info, warn or error)")
+	metricsAddr := flag.String("metrics-listen", "", "Listen address for Prometheus metrics (disabled when empty)")
+	configFile := flag.String("config", "", "Configuration file with per repository settings")
+	showDashboard := flag.Bool("dashboard", false, "Serve a read-only dashboard at /dashboard/ on the webhook listener")
+	dashboardUser := flag.String("dashboard-user", "", "User name for the dashboard")
+	dashboardPassword := flag.String("dashboard-password", "", "Password for the dashboard (no authentication when empty)")
 	flag.Parse()
 
 	if *secret == "" || *token == "" || *username == "" {
@@ -27,17 +47,53 @@ func main() {
 		os.Exit(1)
 	}
 
+	if !validMessageSource(*msgSource) {
+		fmt.Println("Unknown commit message source", *msgSource)
+		os.Exit(1)
+	}
+
+	if !validAuthorsMode(*authorsMode) {
+		fmt.Println("Unknown AUTHORS file mode", *authorsMode)
+		os.Exit(1)
+	}
+
 	allowedUsers := strings.Split(*allow, ",")
 
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Println("Loading configuration:", err)
+		os.Exit(1)
+	}
+
 	db, err := OpenDB(*dbfile)
 	if err != nil {
 		fmt.Println("Opening database:", err)
 		os.Exit(1)
 	}
 
-	log.SetFlags(log.Lshortfile)
+	if *adminAddr != "" && *adminToken == "" {
+		fmt.Println("Must set an admin token to enable the admin API")
+		os.Exit(1)
+	}
+
+	audit, err := newAuditLog(db, *auditFile)
+	if err != nil {
+		fmt.Println("Opening audit log:", err)
+		os.Exit(1)
+	}
+
+	l, err := newLogger(os.Stdout, *logFormat, *logLevel)
+	if err != nil {
+		fmt.Println("Setting up logging:", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(l)
 
-	s := newHandler(allowedUsers, *username, *token, *branches, db, *authorsfile, *mergedLabel)
+	http.DefaultClient.Transport = newRateLimiter(&githubTransport{next: http.DefaultTransport})
+	cache := newPermCache(*permCacheTTL, *permCacheNegativeTTL)
+	registerPermCacheMetrics(cache)
+
+	s := newHandler(allowedUsers, *username, *token, *branches, db, *authorsfile, *mergedLabel, *msgSource, *authorsMode, cfg, cache, newProtectionCache(*protectionCacheTTL), audit, teamcityFromEnv())
 	h := newWebhook(*listenAddr, *secret, *username, *token)
 	h.handleComment("merge", s.handleMerge)
 	h.handleComment("squash", s.handleMerge)
@@ -46,9 +102,37 @@ func main() {
 	h.handleComment("prevent", s.handleStop)
 	h.handleComment("lgtm", s.handleLGTM)
 	h.handleComment("rebuild", s.handleBuild)
+	h.handleComment("freeze", s.handleFreeze)
+	h.handleComment("unfreeze", s.handleUnfreeze)
 	h.handlePR(s.handlePullReq)
+	h.handleMembership(s.handleMembership)
+	h.handleProtectionChange(s.handleProtectionChange)
+	h.addReadinessCheck("database", func(context.Context) error { return db.Ready() })
+	h.addReadinessCheck("github-token", githubTokenCheck(*username, *token, time.Minute))
+	h.addReadinessCheck("clone-dir", writableDirCheck("."))
+	if *showDashboard {
+		h.addHandler("/dashboard/", newDashboard(s.pending, db, *dashboardUser, *dashboardPassword))
+	}
 
 	main := suture.NewSimple("main")
 	main.Add(h)
-	main.Serve()
+	if *adminAddr != "" {
+		main.Add(newAdmin(*adminAddr, *adminToken, db, s))
+	}
+	if *metricsAddr != "" {
+		main.Add(newMetricsServer(*metricsAddr))
+	}
+	main.ServeBackground()
+
+	// Stop gracefully on SIGTERM; stop receiving webhooks, let merges in
+	// progress complete and then close the database.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	sig := <-sigs
+	slog.Info("Shutting down", "signal", sig)
+	main.Stop()
+	s.shutdown()
+	if err := db.Close(); err != nil {
+		slog.Error("Closing database", "error", err)
+	}
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Where to take the squash commit message from, unless overridden in the
+// merge comment.
+const (
+	messageFromCommit   = "commit"   // the first commit in the PR
+	messageFromPR       = "pr"       // the PR title and description
+	messageFromSubjects = "subjects" // the PR title and a list of commit subjects
+)
+
+func validMessageSource(src string) bool {
+	switch src {
+	case messageFromCommit, messageFromPR, messageFromSubjects:
+		return true
+	}
+	return false
+}
+
+var (
+	htmlCommentRe    = regexp.MustCompile(`(?s)<!--.*?-->`)
+	checkboxRe       = regexp.MustCompile(`^\s*[-*+]\s+\[[ xX]\]`)
+	headingRe        = regexp.MustCompile(`^#{1,6}\s+`)
+	imageRe          = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	linkRe           = regexp.MustCompile(`\[([^\]]+)\]\(([^)]+)\)`)
+	strongRe         = regexp.MustCompile(`(\*\*|__)(\S(?:.*?\S)?)(\*\*|__)`)
+	inlineCodeRe     = regexp.MustCompile("`([^`]+)`")
+	listItemRe       = regexp.MustCompile(`^\s*[-*+]\s+`)
+	codeFenceRe      = regexp.MustCompile("^\\s*(```|~~~)")
+	blockQuoteRe     = regexp.MustCompile(`^>\s?`)
+	horizontalRuleRe = regexp.MustCompile(`^\s*([-*_]\s*){3,}$`)
+)
+
+// stripMarkdown turns a GitHub flavored Markdown PR description into
+// something suitable for a commit message. HTML comments and checkbox
+// lines (as commonly left over from PR templates) are removed, inline
+// formatting is dropped and code blocks are indented so that reflow
+// leaves them alone.
+func stripMarkdown(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	s = htmlCommentRe.ReplaceAllString(s, "")
+
+	var lines []string
+	inCode := false
+	for _, line := range strings.Split(s, "\n") {
+		if codeFenceRe.MatchString(line) {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			lines = append(lines, "    "+line)
+			continue
+		}
+		if checkboxRe.MatchString(line) || horizontalRuleRe.MatchString(line) {
+			continue
+		}
+
+		line = strings.TrimRight(line, " \t")
+		line = headingRe.ReplaceAllString(line, "")
+		line = blockQuoteRe.ReplaceAllString(line, "")
+		line = imageRe.ReplaceAllString(line, "$1")
+		line = linkRe.ReplaceAllString(line, "$1 ($2)")
+		line = strongRe.ReplaceAllString(line, "$2")
+		line = inlineCodeRe.ReplaceAllString(line, "$1")
+		if listItemRe.MatchString(line) {
+			// Keep list items on their own lines by indenting them, which
+			// makes reflow pass them verbatim.
+			line = listItemRe.ReplaceAllString(line, " - ")
+		}
+		lines = append(lines, line)
+	}
+
+	// Collapse runs of blank lines left behind by removed content.
+	var res []string
+	for _, line := range lines {
+		if line == "" && (len(res) == 0 || res[len(res)-1] == "") {
+			continue
+		}
+		res = append(res, line)
+	}
+
+	return strings.TrimSpace(strings.Join(res, "\n"))
+}
+
+// prMessage returns a commit message based on the PR title and description.
+func prMessage(title, description string) string {
+	description = stripMarkdown(description)
+	if description == "" {
+		return strings.TrimSpace(title)
+	}
+	return strings.TrimSpace(title) + "\n\n" + reflow(description, 76)
+}
+
+// overrideMessage returns the commit message given in a merge comment.
+// The description is reflowed, except for any trailers at the end of it.
+func overrideMessage(subject, description string) string {
+	subject = strings.TrimSpace(subject)
+	if subject == "" {
+		return ""
+	}
+	text, ts := parseTrailers(subject + "\n\n" + description)
+	text = strings.TrimSpace(strings.TrimPrefix(text, subject))
+	msg := subject
+	if text != "" {
+		msg += "\n\n" + strings.TrimSpace(reflow(text, 76))
+	}
+	if len(ts) == 0 {
+		return msg
+	}
+	return withTrailers(msg, ts)
+}
+
+// subjectsMessage returns a commit message with the PR title as the
+// subject and a bullet list of the commit subjects as the body.
+func subjectsMessage(title string, subjects []string) string {
+	var body []string
+	for _, s := range subjects {
+		if s = strings.TrimSpace(s); s != "" {
+			body = append(body, fmt.Sprintf(" - %s", s))
+		}
+	}
+	return strings.TrimSpace(title) + "\n\n" + strings.Join(body, "\n")
+}
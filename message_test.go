@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestStripMarkdown(t *testing.T) {
+	cases := [][2]string{
+		{"foo", "foo"},
+		{"<!-- Please describe your change -->\nfoo", "foo"},
+		{"### Purpose\n\nFixes the **thing** in `lib/foo`.", "Purpose\n\nFixes the thing in lib/foo."},
+		{"See [the docs](https://example.com/).", "See the docs (https://example.com/)."},
+		{"foo\n\n- [ ] Tests added\n- [x] Docs updated\n\nbar", "foo\n\nbar"},
+		{"foo\n\n* one\n* two", "foo\n\n - one\n - two"},
+		{"foo\n\n```\nx := 1\n```", "foo\n\n    x := 1"},
+		{"foo\r\n<!--\nmulti\nline\n-->\r\nbar", "foo\n\nbar"},
+	}
+
+	for _, tc := range cases {
+		actual := stripMarkdown(tc[0])
+		if actual != tc[1] {
+			t.Errorf("Stripped %q into %q, expected %q", tc[0], actual, tc[1])
+		}
+	}
+}
+
+func TestPRMessage(t *testing.T) {
+	cases := []struct {
+		title, body string
+		msg         string
+	}{
+		{"lib: Fix the thing", "", "lib: Fix the thing"},
+		{"lib: Fix the thing", "<!-- template -->", "lib: Fix the thing"},
+		{"lib: Fix the thing", "This fixes the **thing**.", "lib: Fix the thing\n\nThis fixes the thing.\n"},
+	}
+
+	for _, tc := range cases {
+		actual := prMessage(tc.title, tc.body)
+		if actual != tc.msg {
+			t.Errorf("Got %q, expected %q", actual, tc.msg)
+		}
+	}
+}
+
+func TestOverrideMessage(t *testing.T) {
+	cases := []struct {
+		subject, description string
+		msg                  string
+	}{
+		{"", "Anything", ""},
+		{"lib: Fix the thing", "", "lib: Fix the thing"},
+		{"lib: Fix the thing", "This fixes\nthe thing.", "lib: Fix the thing\n\nThis fixes the thing."},
+		{
+			"lib: Fix the thing",
+			"This fixes\nthe thing.\n\nSigned-off-by: A <a@x>\nSigned-off-by: B <b@x>\nTimeout: 2h",
+			"lib: Fix the thing\n\nThis fixes the thing.\n\nSigned-off-by: A <a@x>\nSigned-off-by: B <b@x>\nTimeout: 2h\n",
+		},
+		{
+			"lib: Fix the thing",
+			"Signed-off-by: A <a@x>\nSigned-off-by: B <b@x>",
+			"lib: Fix the thing\n\nSigned-off-by: A <a@x>\nSigned-off-by: B <b@x>\n",
+		},
+	}
+
+	for _, tc := range cases {
+		actual := overrideMessage(tc.subject, tc.description)
+		if actual != tc.msg {
+			t.Errorf("Got %q, expected %q", actual, tc.msg)
+		}
+	}
+
+	// The trailers survive for squash to pick up
+	_, ts := parseTrailers(cases[3].msg)
+	if ts = ts.remove("Timeout"); len(ts.values("Signed-off-by")) != 2 || len(ts) != 2 {
+		t.Errorf("Unexpected trailers %q", ts)
+	}
+}
+
+func TestSubjectsMessage(t *testing.T) {
+	actual := subjectsMessage("lib: Fix the thing", []string{"first", "", "second"})
+	expected := "lib: Fix the thing\n\n - first\n - second"
+	if actual != expected {
+		t.Errorf("Got %q, expected %q", actual, expected)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricWebhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mergebot",
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook deliveries received, by event type and result.",
+	}, []string{"event", "result"})
+	metricSignatureFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "mergebot",
+		Name:      "webhook_signature_failures_total",
+		Help:      "Webhook deliveries rejected due to an incorrect signature.",
+	})
+	metricCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mergebot",
+		Name:      "commands_total",
+		Help:      "Commands handled, by command and outcome.",
+	}, []string{"command", "outcome"})
+	metricMergeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "mergebot",
+		Name:      "merge_duration_seconds",
+		Help:      "Time taken to perform a merge, from clone to push.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	metricMergeWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "mergebot",
+		Name:      "merge_wait_seconds",
+		Help:      "Time spent waiting for the build status before merging or giving up.",
+		Buckets:   prometheus.ExponentialBuckets(15, 2, 10),
+	})
+	metricPendingMerges = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mergebot",
+		Name:      "pending_merges",
+		Help:      "Merges waiting for the build status to turn green.",
+	})
+	metricGithubRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mergebot",
+		Name:      "github_requests_total",
+		Help:      "Requests to the GitHub API, by HTTP status code or \"error\".",
+	}, []string{"code"})
+	metricGithubRateLimitRemaining = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mergebot",
+		Name:      "github_rate_limit_remaining",
+		Help:      "Remaining GitHub API requests in the current rate limit window.",
+	})
+	metricGitDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "mergebot",
+		Name:      "git_command_duration_seconds",
+		Help:      "Time taken by git commands, by subcommand.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 3, 10),
+	}, []string{"command"})
+)
+
+// registerPermCacheMetrics exposes the hit and miss counts of the
+// permission cache.
+func registerPermCacheMetrics(c *permCache) {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "mergebot",
+		Name:      "permission_cache_hits_total",
+		Help:      "Permission lookups answered from the cache.",
+	}, func() float64 {
+		hits, _ := c.stats()
+		return float64(hits)
+	})
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: "mergebot",
+		Name:      "permission_cache_misses_total",
+		Help:      "Permission lookups not answered from the cache.",
+	}, func() float64 {
+		_, misses := c.stats()
+		return float64(misses)
+	})
+}
+
+// githubTransport counts requests to the GitHub API and keeps track of the
+// remaining rate limit. Other requests pass through untouched.
+type githubTransport struct {
+	next http.RoundTripper
+}
+
+func (t *githubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if !isGitHubAPI(req) {
+		return resp, err
+	}
+
+	if err != nil {
+		metricGithubRequests.WithLabelValues("error").Inc()
+		return resp, err
+	}
+	metricGithubRequests.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	if v, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		metricGithubRateLimitRemaining.Set(float64(v))
+	}
+	return resp, nil
+}
+
+// The commands used as metric labels. Anyone can comment anything, so
+// everything else is counted as "other".
+var knownCommands = map[string]bool{
+	"merge":    true,
+	"squash":   true,
+	"stop":     true,
+	"don't":    true,
+	"prevent":  true,
+	"lgtm":     true,
+	"rebuild":  true,
+	"freeze":   true,
+	"unfreeze": true,
+}
+
+func commandLabel(command string) string {
+	if knownCommands[command] {
+		return command
+	}
+	return "other"
+}
+
+// The metricsServer serves Prometheus metrics on a listener of its own.
+type metricsServer struct {
+	addr   string
+	mut    sync.Mutex
+	server *http.Server
+}
+
+func newMetricsServer(addr string) *metricsServer {
+	return &metricsServer{addr: addr}
+}
+
+func (m *metricsServer) Serve() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	l, err := net.Listen("tcp", m.addr)
+	if err != nil {
+		slog.Error("Listen", "error", err)
+		return
+	}
+
+	slog.Info("Metrics listening", "addr", l.Addr())
+	srv := &http.Server{Handler: mux}
+	m.mut.Lock()
+	m.server = srv
+	m.mut.Unlock()
+	srv.Serve(l)
+}
+
+func (m *metricsServer) Stop() {
+	m.mut.Lock()
+	srv := m.server
+	m.mut.Unlock()
+	if srv != nil {
+		srv.Shutdown(context.Background())
+	}
+}
+
+func observeSince(o prometheus.Observer, t0 time.Time) {
+	o.Observe(time.Since(t0).Seconds())
+}
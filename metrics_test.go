@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeRoundTripper struct {
+	resp *http.Response
+	err  error
+}
+
+func (f fakeRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	return f.resp, f.err
+}
+
+func TestGithubTransport(t *testing.T) {
+	ok := &http.Response{StatusCode: 200, Header: http.Header{"X-Ratelimit-Remaining": []string{"4711"}}}
+	before := testutil.ToFloat64(metricGithubRequests.WithLabelValues("200"))
+	beforeErr := testutil.ToFloat64(metricGithubRequests.WithLabelValues("error"))
+
+	// A GitHub Enterprise server
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = "https://github.example.com/api/v3"
+
+	tr := &githubTransport{next: fakeRoundTripper{resp: ok}}
+	req, _ := http.NewRequest("GET", "https://github.example.com/api/v3/repos/a/b", nil)
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(metricGithubRequests.WithLabelValues("200")); v != before+1 {
+		t.Errorf("Unexpected request count %v", v)
+	}
+	if v := testutil.ToFloat64(metricGithubRateLimitRemaining); v != 4711 {
+		t.Errorf("Unexpected rate limit remaining %v", v)
+	}
+
+	// Requests elsewhere aren't counted
+	for _, u := range []string{"https://build.example.com/", "https://api.github.com/repos/a/b"} {
+		req, _ = http.NewRequest("GET", u, nil)
+		tr.RoundTrip(req)
+	}
+	if v := testutil.ToFloat64(metricGithubRequests.WithLabelValues("200")); v != before+1 {
+		t.Errorf("Unexpected request count %v", v)
+	}
+
+	tr = &githubTransport{next: fakeRoundTripper{err: errors.New("boom")}}
+	req, _ = http.NewRequest("GET", "https://github.example.com/api/v3/repos/a/b", nil)
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Error("Unexpected nil error")
+	}
+	if v := testutil.ToFloat64(metricGithubRequests.WithLabelValues("error")); v != beforeErr+1 {
+		t.Errorf("Unexpected error count %v", v)
+	}
+}
+
+func TestWebhookDeliveryMetrics(t *testing.T) {
+	h := newWebhook(":0", "secret", "mergebot", "token")
+	deliver := func(event, sig string) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+		req.Header.Set("X-Github-Event", event)
+		req.Header.Set("X-Hub-Signature", sig)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte("{}"))
+	good := fmt.Sprintf("sha1=%x", mac.Sum(nil))
+
+	before := testutil.CollectAndCount(metricWebhookDeliveries)
+	unknownBadSig := testutil.ToFloat64(metricWebhookDeliveries.WithLabelValues("unknown", "bad signature"))
+	unknownIgnored := testutil.ToFloat64(metricWebhookDeliveries.WithLabelValues("unknown", "ignored"))
+
+	// Made up event types don't become labels, signed or not
+	deliver("made-up-1", "sha1=bad")
+	deliver("made-up-2", good)
+	deliver("issue_comment", "sha1=bad")
+
+	if v := testutil.ToFloat64(metricWebhookDeliveries.WithLabelValues("unknown", "bad signature")); v != unknownBadSig+2 {
+		t.Errorf("Unexpected bad signature count %v", v)
+	}
+	if v := testutil.ToFloat64(metricWebhookDeliveries.WithLabelValues("unknown", "ignored")); v != unknownIgnored+1 {
+		t.Errorf("Unexpected ignored count %v", v)
+	}
+	if n := testutil.CollectAndCount(metricWebhookDeliveries); n > before+2 {
+		t.Errorf("Unexpected number of series %d, was %d", n, before)
+	}
+}
+
+func TestCommandMetrics(t *testing.T) {
+	before := testutil.CollectAndCount(metricCommands)
+	other := testutil.ToFloat64(metricCommands.WithLabelValues("other", auditDenied))
+
+	os.RemoveAll("_db")
+	defer os.RemoveAll("_db")
+	db, err := OpenDB("_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	a, _ := newAuditLog(db, "")
+
+	// Made up commands don't become labels
+	for _, cmd := range []string{"lgtm-1", "lgtm-2", "mergexyz"} {
+		a.record(auditEntry{Command: cmd, Result: auditDenied})
+	}
+	if v := testutil.ToFloat64(metricCommands.WithLabelValues("other", auditDenied)); v != other+3 {
+		t.Errorf("Unexpected count %v", v)
+	}
+	if n := testutil.CollectAndCount(metricCommands); n > before+1 {
+		t.Errorf("Unexpected number of series %d, was %d", n, before)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A pendingMerge is a merge waiting for the build status to turn green.
+type pendingMerge struct {
+	Repo      string    `json:"repo"`
+	PR        int       `json:"pr"`
+	Requester string    `json:"requester"`
+	Since     time.Time `json:"since"`
+	Deadline  time.Time `json:"deadline"`
+	Status    prState   `json:"status"`
+	Statuses  []status  `json:"statuses"`
+	Scheduled time.Time `json:"scheduled,omitempty"` // waiting for the merge window until then
+
+	cancelled bool
+	cancel    chan struct{} // closed when the merge is cancelled
+	recheck   chan struct{} // signalled to check the status right away
+}
+
+// pendingMerges keeps track of the merges in progress, keyed by
+// repository and PR.
+type pendingMerges struct {
+	mut    sync.Mutex
+	merges map[string]*pendingMerge
+}
+
+func newPendingMerges() *pendingMerges {
+	return &pendingMerges{merges: make(map[string]*pendingMerge)}
+}
+
+func pendingKey(repo string, pr int) string {
+	return fmt.Sprintf("%s#%d", repo, pr)
+}
+
+// add registers the pending merge, unless there already is one for the
+// same PR, in which case nil is returned.
+func (p *pendingMerges) add(pm pendingMerge) *pendingMerge {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	key := pendingKey(pm.Repo, pm.PR)
+	if _, ok := p.merges[key]; ok {
+		return nil
+	}
+	pm.cancel = make(chan struct{})
+	pm.recheck = make(chan struct{}, 1)
+	p.merges[key] = &pm
+	metricPendingMerges.Set(float64(len(p.merges)))
+	return &pm
+}
+
+func (p *pendingMerges) has(repo string, pr int) bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	_, ok := p.merges[pendingKey(repo, pr)]
+	return ok
+}
+
+// remove forgets about the pending merge, if it's still the one
+// registered for its PR.
+func (p *pendingMerges) remove(pm *pendingMerge) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	key := pendingKey(pm.Repo, pm.PR)
+	if p.merges[key] == pm {
+		delete(p.merges, key)
+	}
+	metricPendingMerges.Set(float64(len(p.merges)))
+}
+
+// cancelMerge makes the pending merge give up. It returns false if there
+// is no such merge pending.
+func (p *pendingMerges) cancelMerge(repo string, pr int) bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	pm, ok := p.merges[pendingKey(repo, pr)]
+	if !ok || pm.cancelled {
+		return false
+	}
+	pm.cancelled = true
+	close(pm.cancel)
+	return true
+}
+
+// recheckMerge makes the pending merge check the build status right away.
+// It returns false if there is no such merge pending.
+func (p *pendingMerges) recheckMerge(repo string, pr int) bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	pm, ok := p.merges[pendingKey(repo, pr)]
+	if !ok {
+		return false
+	}
+	select {
+	case pm.recheck <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// update records the latest build status of the pending merge.
+func (p *pendingMerges) update(repo string, pr int, overall prState, ss []status) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	if pm, ok := p.merges[pendingKey(repo, pr)]; ok {
+		pm.Status = overall
+		pm.Statuses = ss
+	}
+}
+
+// schedule records that the pending merge waits for the merge window to
+// open at the given time.
+func (p *pendingMerges) schedule(pm *pendingMerge, t time.Time) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	pm.Scheduled = t
+}
+
+// list returns the pending merges, oldest first.
+func (p *pendingMerges) list() []pendingMerge {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	res := make([]pendingMerge, 0, len(p.merges))
+	for _, pm := range p.merges {
+		res = append(res, *pm)
+	}
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].Since.Before(res[b].Since)
+	})
+	return res
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// permCache caches the answers to permission questions, like whether a
+// user is a collaborator on a repository, for a limited time. Negative
+// answers are cached as well, but usually for a shorter time, so that
+// random commenters don't cause a lookup every time.
+type permCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mut     sync.Mutex
+	entries map[string]permCacheEntry
+	hits    int
+	misses  int
+}
+
+type permCacheEntry struct {
+	value   string
+	expires time.Time
+}
+
+func newPermCache(ttl, negativeTTL time.Duration) *permCache {
+	return &permCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]permCacheEntry),
+	}
+}
+
+// get returns the cached value for the key, if there is one that has not
+// expired.
+func (c *permCache) get(key string) (string, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.entries, key)
+		c.misses++
+		return "", false
+	}
+	c.hits++
+	return e.value, true
+}
+
+// set caches the value for the key. Negative values are kept for the
+// negative TTL, positive ones for the normal TTL.
+func (c *permCache) set(key, value string, positive bool) {
+	ttl := c.ttl
+	if !positive {
+		ttl = c.negativeTTL
+	}
+
+	c.mut.Lock()
+	c.entries[key] = permCacheEntry{value: value, expires: time.Now().Add(ttl)}
+	c.mut.Unlock()
+}
+
+// invalidate removes all entries with keys starting with the prefix.
+func (c *permCache) invalidate(prefix string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// stats returns the number of cache hits and misses so far.
+func (c *permCache) stats() (hits, misses int) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *permCache) String() string {
+	hits, misses := c.stats()
+	rate := 0.0
+	if hits+misses > 0 {
+		rate = 100 * float64(hits) / float64(hits+misses)
+	}
+	return fmt.Sprintf("%d hits, %d misses (%.01f%% hit rate)", hits, misses, rate)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPermCache(t *testing.T) {
+	c := newPermCache(time.Hour, 10*time.Millisecond)
+
+	if _, ok := c.get("collab:a/b:x"); ok {
+		t.Error("Unexpected hit in empty cache")
+	}
+
+	c.set("collab:a/b:x", "yes", true)
+	c.set("collab:a/b:y", "no", false)
+	c.set("collab:c/d:x", "yes", true)
+
+	if v, ok := c.get("collab:a/b:x"); !ok || v != "yes" {
+		t.Errorf("Unexpected %q, %v", v, ok)
+	}
+	if v, ok := c.get("collab:a/b:y"); !ok || v != "no" {
+		t.Errorf("Unexpected %q, %v", v, ok)
+	}
+
+	// The negative entry expires before the positive ones
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.get("collab:a/b:y"); ok {
+		t.Error("Unexpected hit for expired negative entry")
+	}
+	if _, ok := c.get("collab:a/b:x"); !ok {
+		t.Error("Unexpected miss for positive entry")
+	}
+
+	c.invalidate("collab:a/b:")
+	if _, ok := c.get("collab:a/b:x"); ok {
+		t.Error("Unexpected hit for invalidated entry")
+	}
+	if _, ok := c.get("collab:c/d:x"); !ok {
+		t.Error("Unexpected miss for other entry")
+	}
+
+	if hits, misses := c.stats(); hits != 4 || misses != 3 {
+		t.Errorf("Unexpected stats %d hits, %d misses", hits, misses)
+	}
+}
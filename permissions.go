@@ -2,7 +2,8 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"net/url"
 	"sort"
 	"strings"
 
@@ -11,12 +12,63 @@ import (
 )
 
 type permissions struct {
+	username      string
 	token         string
 	alwaysAllowed []string
-	teamMembers   map[string][]string // repo -> list of members
+	config        *config
+	cache         *permCache
 }
 
-func (p *permissions) isAllowed(repo, login string) bool {
+// The repository permission levels, in increasing order.
+var permissionLevels = []string{"none", "read", "triage", "write", "maintain", "admin"}
+
+func permissionRank(level string) int {
+	for i, l := range permissionLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// A rule grants access to a command. Rules are given as strings on one of
+// the forms
+//
+//	collaborator         any collaborator on the repository
+//	user:login           the given user
+//	team:org/slug        members of the given team
+//	team:slug            members of the given team in the repository owner org
+//	permission:level     users with at least the given permission level
+//	                     (read, triage, write, maintain or admin)
+type rule struct {
+	kind  string
+	value string
+}
+
+func parseRule(s string) (rule, error) {
+	if s == "collaborator" {
+		return rule{kind: s}, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return rule{}, fmt.Errorf("invalid rule %q", s)
+	}
+	r := rule{kind: parts[0], value: parts[1]}
+	switch r.kind {
+	case "user", "team":
+	case "permission":
+		if permissionRank(r.value) < 0 {
+			return rule{}, fmt.Errorf("unknown permission level %q", r.value)
+		}
+	default:
+		return rule{}, fmt.Errorf("unknown rule type %q", r.kind)
+	}
+	return r, nil
+}
+
+// isAllowed returns true if the given user may use the given command on
+// the repository.
+func (p *permissions) isAllowed(ctx context.Context, repo, command, login string) bool {
 	// Check the list of always allowed users
 	for _, user := range p.alwaysAllowed {
 		if login == user {
@@ -24,38 +76,216 @@ func (p *permissions) isAllowed(repo, login string) bool {
 		}
 	}
 
-	// Check the cached list of team members for the given repo
-	for _, user := range p.teamMembers[repo] {
-		if login == user {
+	rules := p.rules(repo, command)
+	if len(rules) == 0 {
+		// Any collaborator may do anything
+		rules = []string{"collaborator"}
+	}
+
+	if p.matchesAny(ctx, repo, login, rules) {
+		return true
+	}
+
+	logger(ctx).Info("Permission denied", "login", login, "command", command)
+
+	// Nope, no match
+	return false
+}
+
+// matchesAny returns true if the user matches any of the rules.
+func (p *permissions) matchesAny(ctx context.Context, repo, login string, rules []string) bool {
+	for _, s := range rules {
+		r, err := parseRule(s)
+		if err != nil {
+			// Rules are validated when the config is loaded
+			continue
+		}
+		if p.matches(ctx, repo, login, r) {
 			return true
 		}
 	}
+	return false
+}
+
+// defaultRules are the rules for commands that need more than the usual
+// permissions, unless configured otherwise.
+var defaultRules = map[string][]string{
+	"merge-now": {"permission:admin"},
+	"freeze":    {"permission:maintain"},
+	"unfreeze":  {"permission:maintain"},
+}
+
+func (p *permissions) rules(repo, command string) []string {
+	var perms map[string][]string
+	if p.config != nil {
+		perms = p.config.repo(repo).Permissions
+	}
+	if rules, ok := perms[command]; ok {
+		return rules
+	}
+	if rules, ok := defaultRules[command]; ok {
+		return rules
+	}
+	return perms["*"]
+}
+
+func (p *permissions) matches(ctx context.Context, repo, login string, r rule) bool {
+	switch r.kind {
+	case "collaborator":
+		return p.isCollaborator(ctx, repo, login)
+
+	case "user":
+		return strings.EqualFold(r.value, login)
+
+	case "team":
+		team := r.value
+		if !strings.Contains(team, "/") {
+			team = strings.Split(repo, "/")[0] + "/" + team
+		}
+		ok, err := p.isTeamMember(ctx, team, login)
+		if err != nil {
+			logger(ctx).Error("Checking team membership", "login", login, "team", team, "error", err)
+		}
+		return ok
+
+	case "permission":
+		level, err := p.permissionLevel(ctx, repo, login)
+		if err != nil {
+			logger(ctx).Error("Checking permission level", "login", login, "error", err)
+			return false
+		}
+		return permissionRank(level) >= permissionRank(r.value)
+	}
+	return false
+}
+
+func (p *permissions) isCollaborator(ctx context.Context, repo, login string) bool {
+	key := "collab:" + repo + ":" + login
+	if val, ok := p.cache.get(key); ok {
+		return val == "yes"
+	}
 
-	// Refresh the team members list as it may be out of date
-	log.Println("Refreshing the list of collaborators on", repo, "...")
-	users, err := p.collaborators(repo)
+	// Refresh the list of collaborators as it may be out of date
+	users, err := p.collaborators(ctx, repo)
 	if err != nil {
+		logger(ctx).Error("Refreshing the list of collaborators", "error", err)
 		return false
 	}
-	log.Println(" ... got", users)
-	p.teamMembers[repo] = users
-	for _, user := range p.teamMembers[repo] {
+	logger(ctx).Info("Refreshed the list of collaborators", "collaborators", users, "cache", p.cache.String())
+
+	found := false
+	for _, user := range users {
+		p.cache.set("collab:"+repo+":"+user, "yes", true)
 		if login == user {
-			return true
+			found = true
 		}
 	}
+	if !found {
+		p.cache.set(key, "no", false)
+	}
+	return found
+}
 
-	log.Println("Permission denied for", login)
+// permissionLevel returns the permission level the user has on the
+// repository, taking fine grained roles like triage and maintain into
+// account.
+func (p *permissions) permissionLevel(ctx context.Context, repo, login string) (string, error) {
+	key := "perm:" + repo + ":" + login
+	if val, ok := p.cache.get(key); ok {
+		return val, nil
+	}
 
-	// Nope, no match
-	return false
+	var res struct {
+		Permission string
+		RoleName   string `json:"role_name"`
+	}
+	u := fmt.Sprintf("%s/repos/%s/collaborators/%s/permission", githubAPIURL, repo, url.PathEscape(login))
+	if err := githubGet(ctx, u, p.username, p.token, &res); err == errNotFound {
+		p.cache.set(key, "none", false)
+		return "none", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	level := res.Permission
+	if permissionRank(res.RoleName) >= 0 {
+		level = res.RoleName
+	}
+	p.cache.set(key, level, permissionRank(level) > permissionRank("none"))
+	return level, nil
+}
+
+// isTeamMember returns true if the user is an active member of the team,
+// given as org/slug.
+func (p *permissions) isTeamMember(ctx context.Context, team, login string) (bool, error) {
+	key := "team:" + team + ":" + login
+	if val, ok := p.cache.get(key); ok {
+		return val == "yes", nil
+	}
+
+	parts := strings.SplitN(team, "/", 2)
+	var res struct {
+		State string
+	}
+	u := fmt.Sprintf("%s/orgs/%s/teams/%s/memberships/%s", githubAPIURL, parts[0], parts[1], url.PathEscape(login))
+	if err := githubGet(ctx, u, p.username, p.token, &res); err == errNotFound {
+		p.cache.set(key, "no", false)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if res.State != "active" {
+		p.cache.set(key, "no", false)
+		return false, nil
+	}
+	p.cache.set(key, "yes", true)
+	return true, nil
+}
+
+// membership is the interesting parts of the member, membership and team
+// webhook events.
+type membership struct {
+	Event  string `json:"-"`
+	Action string
+	Member struct {
+		Login string
+	}
+	Team struct {
+		Slug string
+	}
+	Organization struct {
+		Login string
+	}
+	Repository struct {
+		FullName string `json:"full_name"`
+	}
+}
+
+// handleMembership invalidates cached permissions affected by changes to
+// repository collaborators, team memberships and team repository access.
+func (p *permissions) handleMembership(ctx context.Context, m membership) {
+	switch m.Event {
+	case "member":
+		p.cache.invalidate("collab:" + m.Repository.FullName + ":" + m.Member.Login)
+		p.cache.invalidate("perm:" + m.Repository.FullName + ":" + m.Member.Login)
+	case "membership":
+		p.cache.invalidate("team:" + m.Organization.Login + "/" + m.Team.Slug + ":" + m.Member.Login)
+		// Team membership also affects repository permissions
+		p.cache.invalidate("collab:")
+		p.cache.invalidate("perm:")
+	case "team":
+		p.cache.invalidate("collab:" + m.Repository.FullName + ":")
+		p.cache.invalidate("perm:" + m.Repository.FullName + ":")
+	}
+	logger(ctx).Info("Invalidated cached permissions", "cache", p.cache.String())
 }
 
-func (p *permissions) collaborators(repo string) ([]string, error) {
+func (p *permissions) collaborators(ctx context.Context, repo string) ([]string, error) {
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: p.token},
 	)
-	tc := oauth2.NewClient(oauth2.NoContext, ts)
+	tc := oauth2.NewClient(ctx, ts)
 
 	client := github.NewClient(tc)
 
@@ -65,7 +295,7 @@ func (p *permissions) collaborators(repo string) ([]string, error) {
 	ps := strings.Split(repo, "/")
 	owner, repo := ps[0], ps[1]
 	for {
-		users, resp, err := client.Repositories.ListCollaborators(context.TODO(), owner, repo, opt)
+		users, resp, err := client.Repositories.ListCollaborators(ctx, owner, repo, opt)
 		if err != nil {
 			return nil, err
 		}
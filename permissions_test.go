@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	cases := []struct {
+		in  string
+		out rule
+		ok  bool
+	}{
+		{"collaborator", rule{kind: "collaborator"}, true},
+		{"user:calmh", rule{"user", "calmh"}, true},
+		{"team:syncthing/maintainers", rule{"team", "syncthing/maintainers"}, true},
+		{"permission:triage", rule{"permission", "triage"}, true},
+		{"permission:superuser", rule{}, false},
+		{"user:", rule{}, false},
+		{"group:foo", rule{}, false},
+		{"calmh", rule{}, false},
+	}
+
+	for _, tc := range cases {
+		r, err := parseRule(tc.in)
+		if tc.ok && (err != nil || r != tc.out) {
+			t.Errorf("Parsing %q: got %v, %v, expected %v", tc.in, r, err, tc.out)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("Parsing %q: unexpected nil error", tc.in)
+		}
+	}
+}
+
+func TestIsAllowed(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/repos/a/b/collaborators/writer/permission":
+			fmt.Fprint(w, `{"permission": "write", "role_name": "write"}`)
+		case "/repos/a/b/collaborators/triager/permission":
+			fmt.Fprint(w, `{"permission": "read", "role_name": "triage"}`)
+		case "/orgs/a/teams/reviewers/memberships/reviewer":
+			fmt.Fprint(w, `{"state": "active"}`)
+		case "/orgs/a/teams/reviewers/memberships/invited":
+			fmt.Fprint(w, `{"state": "pending"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = srv.URL
+
+	p := &permissions{
+		alwaysAllowed: []string{"admin"},
+		cache:         newPermCache(time.Minute, time.Minute),
+		config: &config{Repos: map[string]repoConfig{
+			"*": {Permissions: map[string][]string{
+				"*":    {"permission:write"},
+				"lgtm": {"permission:triage", "team:reviewers", "user:friend"},
+			}},
+		}},
+	}
+
+	cases := []struct {
+		command string
+		login   string
+		ok      bool
+	}{
+		{"merge", "admin", true},
+		{"merge", "writer", true},
+		{"merge", "triager", false},
+		{"merge", "reviewer", false},
+		{"merge", "stranger", false},
+		{"lgtm", "writer", true},
+		{"lgtm", "triager", true},
+		{"lgtm", "reviewer", true},
+		{"lgtm", "invited", false},
+		{"lgtm", "friend", true},
+		{"lgtm", "stranger", false},
+	}
+
+	for _, tc := range cases {
+		if ok := p.isAllowed(context.Background(), "a/b", tc.command, tc.login); ok != tc.ok {
+			t.Errorf("%s by %s: got %v, expected %v", tc.command, tc.login, ok, tc.ok)
+		}
+	}
+
+	// Everything is cached now, including the denials
+	requests = 0
+	for _, tc := range cases {
+		p.isAllowed(context.Background(), "a/b", tc.command, tc.login)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no requests with a warm cache, got %d", requests)
+	}
+
+	// Until a membership change comes in
+	p.handleMembership(context.Background(), membership{Event: "membership", Member: struct{ Login string }{"reviewer"}})
+	p.isAllowed(context.Background(), "a/b", "lgtm", "reviewer")
+	if requests == 0 {
+		t.Error("Expected requests after invalidation")
+	}
+}
+
+func TestDefaultRules(t *testing.T) {
+	p := &permissions{}
+	if rules := p.rules("a/b", "merge-now"); !reflect.DeepEqual(rules, []string{"permission:admin"}) {
+		t.Errorf("Unexpected rules %v", rules)
+	}
+
+	p.config = &config{Repos: map[string]repoConfig{
+		"*":   {Permissions: map[string][]string{"*": {"permission:write"}}},
+		"a/b": {Permissions: map[string][]string{"merge-now": {"team:release"}}},
+	}}
+	if rules := p.rules("a/c", "merge-now"); !reflect.DeepEqual(rules, []string{"permission:admin"}) {
+		t.Errorf("Unexpected rules %v", rules)
+	}
+	if rules := p.rules("a/b", "merge-now"); !reflect.DeepEqual(rules, []string{"team:release"}) {
+		t.Errorf("Unexpected rules %v", rules)
+	}
+	if rules := p.rules("a/c", "merge"); !reflect.DeepEqual(rules, []string{"permission:write"}) {
+		t.Errorf("Unexpected rules %v", rules)
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"fmt"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 )
@@ -16,6 +18,9 @@ type pr struct {
 		Head struct {
 			SHA string
 		}
+		Base struct {
+			Ref string
+		}
 	} `json:"pull_request"`
 	Repository struct {
 		FullName    string `json:"full_name"`
@@ -27,9 +32,20 @@ type pr struct {
 	Base        struct { // set when getting manually
 		Ref  string
 		Repo struct {
-			URL string
+			URL           string
+			FullName      string `json:"full_name"`
+			DefaultBranch string `json:"default_branch"`
 		}
 	}
+	Head struct { // set when getting manually
+		SHA string
+		Ref string
+	}
+	Title string   // set when getting manually
+	Body  string   // set when getting manually
+	User  struct { // set when getting manually
+		Login string
+	}
 }
 
 type prState string
@@ -42,6 +58,7 @@ const (
 )
 
 type status struct {
+	ID      int64
 	State   prState
 	Context string
 	Creator struct {
@@ -49,12 +66,52 @@ type status struct {
 	}
 }
 
-func (p *pr) setStatus(state prState, context, description, username, token string) {
+// baseRef returns the name of the branch the PR targets.
+func (p *pr) baseRef() string {
+	if p.Base.Ref != "" {
+		return p.Base.Ref
+	}
+	return p.PullRequest.Base.Ref
+}
+
+// openPRs returns the open PRs targeting the branch.
+func openPRs(ctx context.Context, repo, branch, username, token string) ([]pr, error) {
+	var res []pr
+	for page := 1; ; page++ {
+		var prs []pr
+		u := fmt.Sprintf("%s/repos/%s/pulls?state=open&base=%s&per_page=100&page=%d", githubAPIURL, repo, url.QueryEscape(branch), page)
+		if err := githubGet(ctx, u, username, token, &prs); err != nil {
+			return nil, err
+		}
+		res = append(res, prs...)
+		if len(prs) < 100 {
+			return res, nil
+		}
+	}
+}
+
+// headSHA returns the commit at the head of the PR.
+func (p *pr) headSHA() string {
+	if p.Head.SHA != "" {
+		return p.Head.SHA
+	}
+	return p.PullRequest.Head.SHA
+}
+
+// repo returns the full name of the repository the PR belongs to.
+func (p *pr) repo() string {
+	if p.Repository.FullName != "" {
+		return p.Repository.FullName
+	}
+	return p.Base.Repo.FullName
+}
+
+func (p *pr) setStatus(ctx context.Context, state prState, statusContext, description, username, token string) {
 	buf := new(bytes.Buffer)
 	json.NewEncoder(buf).Encode(map[string]string{
 		"state":       string(state),
 		"description": description,
-		"context":     context,
+		"context":     statusContext,
 	})
 
 	url := p.StatusesURL
@@ -63,118 +120,73 @@ func (p *pr) setStatus(state prState, context, description, username, token stri
 	}
 	url = strings.Replace(url, "{sha}", p.PullRequest.Head.SHA, 1)
 
-	req, err := http.NewRequest("POST", url, buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, buf)
 	if err != nil {
-		log.Println("Request:", err)
+		logger(ctx).Error("Request", "error", err)
 		return
 	}
 	req.SetBasicAuth(username, token)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Println("Post:", err)
+		logger(ctx).Error("Post", "error", err)
 		return
 	}
 	resp.Body.Close()
 
 	if resp.StatusCode > 299 {
-		log.Println("Post:", resp.Status)
+		logger(ctx).Error("Post", "status", resp.Status)
 		return
 	}
 }
 
-func (p *pr) setLabel(label, username, token string) {
+func (p *pr) setLabel(ctx context.Context, label, username, token string) {
 	buf := new(bytes.Buffer)
 	json.NewEncoder(buf).Encode([]string{label})
 
-	req, err := http.NewRequest("POST", p.IssueURL+"/labels", buf)
+	req, err := http.NewRequestWithContext(ctx, "POST", p.IssueURL+"/labels", buf)
 	if err != nil {
-		log.Println("Request:", err)
+		logger(ctx).Error("Request", "error", err)
 		return
 	}
 	req.SetBasicAuth(username, token)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Println("Post:", err)
+		logger(ctx).Error("Post", "error", err)
 		return
 	}
 	resp.Body.Close()
 
 	if resp.StatusCode > 299 {
-		log.Println("Post:", resp.Status)
+		logger(ctx).Error("Post", "status", resp.Status)
 		return
 	}
 }
 
-type branch struct {
-	Protection struct {
-		Enabled bool
-		Checks  struct {
-			Contexts []string
-		} `json:"required_status_checks"`
-	}
-}
-
-func (p *pr) getRequiredStatuses(username, token string) []string {
-	url := p.Base.Repo.URL + "/branches/" + p.Base.Ref
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Println("Request:", err)
-		return nil
-	}
-	req.SetBasicAuth(username, token)
-	req.Header.Set("Accept", "application/vnd.github.loki-preview")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		log.Println("Get:", err)
-		return nil
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode > 299 {
-		log.Println("Get:", resp.Status)
-		return nil
-	}
-
-	var tmp branch
-	if err := json.NewDecoder(resp.Body).Decode(&tmp); err != nil {
-		log.Println("JSON:", err)
-		return nil
-	}
-
-	if !tmp.Protection.Enabled {
-		return nil
-	}
-
-	log.Println("Required checks:", tmp.Protection.Checks.Contexts)
-	return tmp.Protection.Checks.Contexts
-}
-
-func (p *pr) getStatuses(username, token string) []status {
-	req, err := http.NewRequest("GET", p.StatusesURL, nil)
+func (p *pr) getStatuses(ctx context.Context, username, token string) []status {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.StatusesURL, nil)
 	if err != nil {
-		log.Println("Request:", err)
+		logger(ctx).Error("Request", "error", err)
 		return nil
 	}
 	req.SetBasicAuth(username, token)
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Println("Get:", err)
+		logger(ctx).Error("Get", "error", err)
 		return nil
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode > 299 {
-		log.Println("Post:", resp.Status)
+		logger(ctx).Error("Post", "status", resp.Status)
 		return nil
 	}
 
 	var tmp []status
 	if err := json.NewDecoder(resp.Body).Decode(&tmp); err != nil {
-		log.Println("JSON:", err)
+		logger(ctx).Error("JSON", "error", err)
 		return nil
 	}
 
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The protection requirements for a branch, from classic branch protection
+// and repository rulesets combined.
+type protection struct {
+	Contexts     []string // required status check contexts
+	Reviews      int      // required number of approving reviews
+	DismissStale bool     // approvals are dismissed by new commits
+	CodeOwners   bool     // code owners must approve
+
+	// The app that must set each required context, for those pinned to
+	// one. We only see commit statuses, which don't tell which app set
+	// them, so these are informational and contexts are matched by name
+	// alone.
+	Apps map[string]int
+}
+
+// contexts returns the required status check contexts, without duplicates.
+func (p protection) contexts() []string {
+	var res []string
+	seen := make(map[string]bool)
+	for _, c := range p.Contexts {
+		if !seen[c] {
+			res = append(res, c)
+			seen[c] = true
+		}
+	}
+	return res
+}
+
+// add combines the requirements in o with ours, the stricter requirement
+// winning.
+func (p *protection) add(o protection) {
+	p.Contexts = append(p.Contexts, o.Contexts...)
+	if o.Reviews > p.Reviews {
+		p.Reviews = o.Reviews
+	}
+	p.DismissStale = p.DismissStale || o.DismissStale
+	p.CodeOwners = p.CodeOwners || o.CodeOwners
+	for context, app := range o.Apps {
+		p.pin(context, app)
+	}
+}
+
+// pin records that the context must be set by the given app.
+func (p *protection) pin(context string, app int) {
+	if p.Apps == nil {
+		p.Apps = make(map[string]int)
+	}
+	p.Apps[context] = app
+}
+
+// The response from the branch protection endpoint. Required checks may
+// be pinned to the app that must set them.
+type branchProtection struct {
+	RequiredStatusChecks *struct {
+		Contexts []string
+		Checks   []struct {
+			Context string
+			AppID   int `json:"app_id"`
+		}
+	} `json:"required_status_checks"`
+	RequiredPullRequestReviews *struct {
+		DismissStaleReviews          bool `json:"dismiss_stale_reviews"`
+		RequireCodeOwnerReviews      bool `json:"require_code_owner_reviews"`
+		RequiredApprovingReviewCount int  `json:"required_approving_review_count"`
+	} `json:"required_pull_request_reviews"`
+}
+
+func (b branchProtection) protection() protection {
+	var p protection
+	if c := b.RequiredStatusChecks; c != nil {
+		p.Contexts = c.Contexts
+		for _, check := range c.Checks {
+			p.Contexts = append(p.Contexts, check.Context)
+			if check.AppID != 0 {
+				p.pin(check.Context, check.AppID)
+			}
+		}
+	}
+	if r := b.RequiredPullRequestReviews; r != nil {
+		p.Reviews = r.RequiredApprovingReviewCount
+		p.DismissStale = r.DismissStaleReviews
+		p.CodeOwners = r.RequireCodeOwnerReviews
+	}
+	return p
+}
+
+// A rule from the rulesets that apply to a branch.
+type branchRule struct {
+	Type       string
+	Parameters struct {
+		// required_status_checks
+		RequiredChecks []struct {
+			Context       string
+			IntegrationID int `json:"integration_id"`
+		} `json:"required_status_checks"`
+		// pull_request
+		RequiredApprovingReviewCount int  `json:"required_approving_review_count"`
+		DismissStaleReviewsOnPush    bool `json:"dismiss_stale_reviews_on_push"`
+		RequireCodeOwnerReview       bool `json:"require_code_owner_review"`
+	}
+}
+
+func (r branchRule) protection() protection {
+	var p protection
+	switch r.Type {
+	case "required_status_checks":
+		for _, check := range r.Parameters.RequiredChecks {
+			p.Contexts = append(p.Contexts, check.Context)
+			if check.IntegrationID != 0 {
+				p.pin(check.Context, check.IntegrationID)
+			}
+		}
+	case "pull_request":
+		p.Reviews = r.Parameters.RequiredApprovingReviewCount
+		p.DismissStale = r.Parameters.DismissStaleReviewsOnPush
+		p.CodeOwners = r.Parameters.RequireCodeOwnerReview
+	}
+	return p
+}
+
+// getProtection returns the protection requirements for the branch.
+func getProtection(ctx context.Context, repo, branch, username, token string) (protection, error) {
+	base := fmt.Sprintf("%s/repos/%s/branches/%s", githubAPIURL, repo, url.PathEscape(branch))
+
+	var res protection
+	var bp branchProtection
+	switch err := githubGet(ctx, base+"/protection", username, token, &bp); err {
+	case nil:
+		res = bp.protection()
+	case errNotFound, errForbidden:
+		// Reading the protection settings requires admin access, and
+		// without it GitHub usually answers 404 as if the branch wasn't
+		// protected. The branch itself still shows the required status
+		// checks.
+		var b struct {
+			Protection branchProtection
+		}
+		switch err := githubGet(ctx, base, username, token, &b); err {
+		case nil:
+			res = b.Protection.protection()
+		case errNotFound:
+			// No such branch
+		default:
+			return protection{}, err
+		}
+	default:
+		return protection{}, err
+	}
+
+	var rules []branchRule
+	u := fmt.Sprintf("%s/repos/%s/rules/branches/%s", githubAPIURL, repo, url.PathEscape(branch))
+	switch err := githubGet(ctx, u, username, token, &rules); err {
+	case nil, errNotFound:
+	default:
+		return protection{}, err
+	}
+	for _, r := range rules {
+		res.add(r.protection())
+	}
+
+	return res, nil
+}
+
+// The protectionCache keeps branch protection requirements per repository
+// and branch, as they're needed on every poll while waiting to merge.
+type protectionCache struct {
+	ttl time.Duration
+
+	mut     sync.Mutex
+	entries map[string]protectionCacheEntry
+}
+
+type protectionCacheEntry struct {
+	protection protection
+	expires    time.Time
+}
+
+func newProtectionCache(ttl time.Duration) *protectionCache {
+	return &protectionCache{
+		ttl:     ttl,
+		entries: make(map[string]protectionCacheEntry),
+	}
+}
+
+func protectionKey(repo, branch string) string {
+	return repo + ":" + branch
+}
+
+func (c *protectionCache) get(repo, branch string) (protection, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	key := protectionKey(repo, branch)
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return protection{}, false
+	}
+	return e.protection, true
+}
+
+func (c *protectionCache) set(repo, branch string, p protection) {
+	c.mut.Lock()
+	c.entries[protectionKey(repo, branch)] = protectionCacheEntry{protection: p, expires: time.Now().Add(c.ttl)}
+	c.mut.Unlock()
+}
+
+// invalidate removes the cached requirements for all branches in the
+// repository, or for all repositories when repo is empty.
+func (c *protectionCache) invalidate(repo string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for key := range c.entries {
+		if repo == "" || strings.HasPrefix(key, repo+":") {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// branchProtection returns the protection requirements for the branch the
+// PR targets.
+func (h *handler) branchProtection(ctx context.Context, p pr) (protection, error) {
+	repo, branch := p.repo(), p.baseRef()
+	if prot, ok := h.protection.get(repo, branch); ok {
+		return prot, nil
+	}
+
+	prot, err := getProtection(ctx, repo, branch, h.username, h.token)
+	if err != nil {
+		return protection{}, err
+	}
+	logger(ctx).Debug("Branch protection", "branch", branch, "contexts", prot.contexts(), "apps", prot.Apps, "reviews", prot.Reviews)
+	h.protection.set(repo, branch, prot)
+	return prot, nil
+}
+
+// requiredContexts returns the status contexts required by the branch
+// protection. Errors are logged and result in no required contexts, as
+// the build status is checked anyway.
+func (h *handler) requiredContexts(ctx context.Context, p pr) []string {
+	prot, err := h.branchProtection(ctx, p)
+	if err != nil {
+		logger(ctx).Error("Getting branch protection", "branch", p.baseRef(), "error", err)
+		return nil
+	}
+	return prot.contexts()
+}
+
+// A protectionChange is a branch_protection_rule or repository_ruleset
+// event.
+type protectionChange struct {
+	Event      string `json:"-"`
+	Action     string
+	Repository struct {
+		FullName string `json:"full_name"`
+	}
+}
+
+// handleProtectionChange forgets the cached protection requirements
+// affected by the change. Organization rulesets come without a
+// repository and may affect any of them.
+func (h *handler) handleProtectionChange(ctx context.Context, pc protectionChange) {
+	logger(ctx).Info("Invalidating cached branch protection", "repo", pc.Repository.FullName)
+	h.protection.invalidate(pc.Repository.FullName)
+}
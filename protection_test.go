@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetProtection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/a/b/branches/main/protection":
+			fmt.Fprint(w, `{
+				"required_status_checks": {"strict": true, "contexts": ["build", "lint"], "checks": [{"context": "build", "app_id": 42}, {"context": "lint", "app_id": null}]},
+				"required_pull_request_reviews": {"dismiss_stale_reviews": true, "required_approving_review_count": 1}
+			}`)
+		case "/repos/a/b/rules/branches/main":
+			fmt.Fprint(w, `[
+				{"type": "required_status_checks", "parameters": {"required_status_checks": [{"context": "security", "integration_id": 7}]}},
+				{"type": "pull_request", "parameters": {"required_approving_review_count": 2, "require_code_owner_review": true}},
+				{"type": "deletion"}
+			]`)
+		case "/repos/a/b/branches/release/protection":
+			http.Error(w, "Resource not accessible by integration", http.StatusForbidden)
+		case "/repos/a/b/branches/release":
+			fmt.Fprint(w, `{"protected": true, "protection": {"enabled": true, "required_status_checks": {"contexts": ["build"], "checks": [{"context": "build", "app_id": null}]}}}`)
+		case "/repos/a/b/branches/hidden":
+			fmt.Fprint(w, `{"protected": true, "protection": {"enabled": true, "required_status_checks": {"contexts": [], "checks": [{"context": "test", "app_id": 42}]}}}`)
+		case "/repos/a/b/branches/feature":
+			fmt.Fprint(w, `{"protected": false, "protection": {"enabled": false}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = srv.URL
+
+	p, err := getProtection(context.Background(), "a/b", "main", "mergebot", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.contexts(), []string{"build", "lint", "security"}) {
+		t.Errorf("Unexpected contexts %v", p.contexts())
+	}
+	if p.Reviews != 2 || !p.DismissStale || !p.CodeOwners {
+		t.Errorf("Unexpected requirements %+v", p)
+	}
+	if !reflect.DeepEqual(p.Apps, map[string]int{"build": 42, "security": 7}) {
+		t.Errorf("Unexpected apps %v", p.Apps)
+	}
+
+	// Without admin access we still get the required checks
+	p, err = getProtection(context.Background(), "a/b", "release", "mergebot", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.contexts(), []string{"build"}) {
+		t.Errorf("Unexpected contexts %v", p.contexts())
+	}
+
+	// Without admin access GitHub usually pretends the protection
+	// doesn't exist
+	p, err = getProtection(context.Background(), "a/b", "hidden", "mergebot", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.contexts(), []string{"test"}) {
+		t.Errorf("Unexpected contexts %v", p.contexts())
+	}
+
+	// Unprotected
+	p, err = getProtection(context.Background(), "a/b", "feature", "mergebot", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, protection{}) {
+		t.Errorf("Unexpected protection %+v", p)
+	}
+}
+
+func TestProtectionCache(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/a/b/branches/main/protection" {
+			requests++
+			fmt.Fprint(w, `{"required_status_checks": {"contexts": ["build"]}}`)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = srv.URL
+
+	h := &handler{username: "mergebot", token: "token", protection: newProtectionCache(time.Minute)}
+	var p pr
+	p.Repository.FullName = "a/b"
+	p.PullRequest.Base.Ref = "main"
+
+	for i := 0; i < 3; i++ {
+		if c := h.requiredContexts(context.Background(), p); !reflect.DeepEqual(c, []string{"build"}) {
+			t.Errorf("Unexpected contexts %v", c)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Unexpected number of requests %d", requests)
+	}
+
+	// Changes to other repos don't matter
+	var pc protectionChange
+	pc.Repository.FullName = "a/c"
+	h.handleProtectionChange(context.Background(), pc)
+	h.requiredContexts(context.Background(), p)
+	if requests != 1 {
+		t.Errorf("Unexpected number of requests %d", requests)
+	}
+
+	// Organization rulesets affect all of them
+	h.handleProtectionChange(context.Background(), protectionChange{Event: "repository_ruleset"})
+	h.requiredContexts(context.Background(), p)
+	if requests != 2 {
+		t.Errorf("Unexpected number of requests %d", requests)
+	}
+}
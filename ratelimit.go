@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// When fewer requests than this remain in the rate limit window, we
+	// spread the remaining ones out over what's left of the window.
+	rateLimitReserve = 100
+	// How many times to retry a request after a secondary rate limit.
+	maxRateLimitRetries = 3
+	// How many conditional responses to keep.
+	etagCacheSize = 1000
+)
+
+// The rateLimiter is a RoundTripper for the GitHub API that keeps track of
+// the rate limit, slows down and queues requests when it runs low, waits
+// out secondary rate limits and uses conditional requests for lookups
+// that are repeated a lot. Requests to other hosts pass through.
+type rateLimiter struct {
+	next http.RoundTripper
+
+	mut          sync.Mutex
+	remaining    int // -1 when unknown
+	reset        time.Time
+	blockedUntil time.Time // secondary rate limit
+
+	queue chan struct{} // held while pacing requests
+	etags *etagCache
+
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+func newRateLimiter(next http.RoundTripper) *rateLimiter {
+	return &rateLimiter{
+		next:      next,
+		remaining: -1,
+		queue:     make(chan struct{}, 1),
+		etags:     newETagCache(etagCacheSize),
+		now:       time.Now,
+		sleep:     sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isGitHubAPI returns true for requests to the GitHub API.
+func isGitHubAPI(req *http.Request) bool {
+	u, err := url.Parse(githubAPIURL)
+	return err == nil && req.URL.Host == u.Host
+}
+
+func (l *rateLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isGitHubAPI(req) {
+		return l.next.RoundTrip(req)
+	}
+
+	cacheable := req.Method == "GET" && isConditionalURL(req.URL)
+	key := etagKey(req)
+
+	for attempt := 0; ; attempt++ {
+		if err := l.throttle(req.Context()); err != nil {
+			return nil, err
+		}
+
+		r := req
+		if cacheable {
+			if etag := l.etags.etag(key); etag != "" {
+				r = req.Clone(req.Context())
+				r.Header.Set("If-None-Match", etag)
+			}
+		} else if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				// Can't send the body again
+				return nil, errRateLimited
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		resp, err := l.next.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+		l.update(resp)
+
+		if wait, ok := l.secondaryLimit(resp); ok && attempt < maxRateLimitRetries {
+			resp.Body.Close()
+			logger(req.Context()).Warn("Hit GitHub secondary rate limit", "retry-after", wait, "url", req.URL.String())
+			l.block(wait)
+			continue
+		}
+
+		if cacheable {
+			return l.etags.handle(key, resp)
+		}
+		return resp, nil
+	}
+}
+
+// throttle waits as long as needed before making a request.
+func (l *rateLimiter) throttle(ctx context.Context) error {
+	l.mut.Lock()
+	now := l.now()
+	var wait time.Duration
+	if l.blockedUntil.After(now) {
+		wait = l.blockedUntil.Sub(now)
+	}
+	paced := false
+	if l.remaining >= 0 && l.remaining < rateLimitReserve && l.reset.After(now) {
+		paced = true
+		if l.remaining == 0 {
+			if d := l.reset.Sub(now); d > wait {
+				wait = d
+			}
+		} else if d := l.reset.Sub(now) / time.Duration(l.remaining+1); d > wait {
+			wait = d
+		}
+	}
+	l.mut.Unlock()
+
+	if !paced {
+		return l.sleep(ctx, wait)
+	}
+
+	// Pace requests one at a time, in the order they arrive.
+	select {
+	case l.queue <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-l.queue }()
+	return l.sleep(ctx, wait)
+}
+
+// update records the rate limit state from the response headers.
+func (l *rateLimiter) update(resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	l.mut.Lock()
+	l.remaining = remaining
+	l.reset = time.Unix(reset, 0)
+	l.mut.Unlock()
+}
+
+// secondaryLimit returns how long to wait if the response says we've hit
+// a secondary rate limit.
+func (l *rateLimiter) secondaryLimit(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		// Primary rate limit; throttle will wait for the reset.
+		return 0, true
+	}
+	return 0, false
+}
+
+func (l *rateLimiter) block(d time.Duration) {
+	l.mut.Lock()
+	if until := l.now().Add(d); until.After(l.blockedUntil) {
+		l.blockedUntil = until
+	}
+	l.mut.Unlock()
+}
+
+var errRateLimited = errors.New("rate limited by GitHub")
+
+// isConditionalURL returns true for the lookups we make repeatedly while
+// waiting for builds: statuses and branch protection.
+func isConditionalURL(u *url.URL) bool {
+	return strings.Contains(u.Path, "/status") ||
+		strings.HasSuffix(u.Path, "/protection") ||
+		strings.Contains(u.Path, "/rules/branches/")
+}
+
+func etagKey(req *http.Request) string {
+	return req.URL.String() + " " + req.Header.Get("Accept") + " " + req.Header.Get("Authorization")
+}
+
+// The etagCache keeps the last response with an ETag per request, to
+// answer 304 Not Modified responses with.
+type etagCache struct {
+	size    int
+	mut     sync.Mutex
+	entries map[string]etagEntry
+}
+
+type etagEntry struct {
+	etag string
+	resp []byte // dumped response
+}
+
+func newETagCache(size int) *etagCache {
+	return &etagCache{size: size, entries: make(map[string]etagEntry)}
+}
+
+func (c *etagCache) etag(key string) string {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.entries[key].etag
+}
+
+// handle returns the cached response for a 304 response, and caches
+// other successful responses with an ETag.
+func (c *etagCache) handle(key string, resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode == http.StatusNotModified {
+		c.mut.Lock()
+		e, ok := c.entries[key]
+		c.mut.Unlock()
+		if ok {
+			cached, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(e.resp)), resp.Request)
+			if err == nil {
+				resp.Body.Close()
+				return cached, nil
+			}
+		}
+		return resp, nil
+	}
+
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		return resp, nil
+	}
+	dump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mut.Lock()
+	if len(c.entries) >= c.size {
+		// Evict something; which doesn't matter much
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = etagEntry{etag: etag, resp: dump}
+	c.mut.Unlock()
+	return resp, nil
+}
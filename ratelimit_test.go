@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterETags(t *testing.T) {
+	requests, notModified := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+		fmt.Fprint(w, `{"state":"success"}`)
+	}))
+	defer srv.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = srv.URL
+
+	client := &http.Client{Transport: newRateLimiter(http.DefaultTransport)}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL + "/repos/a/b/commits/abc123/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != `{"state":"success"}` {
+			t.Errorf("Unexpected response %d %q", resp.StatusCode, body)
+		}
+	}
+	if requests != 3 || notModified != 2 {
+		t.Errorf("Unexpected requests %d, not modified %d", requests, notModified)
+	}
+
+	// Other lookups aren't conditional
+	resp, err := client.Get(srv.URL + "/repos/a/b/pulls/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = client.Get(srv.URL + "/repos/a/b/pulls/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if notModified != 2 {
+		t.Errorf("Unexpected conditional request for a pull request")
+	}
+}
+
+func TestRateLimiterSecondaryLimit(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "hello" {
+			t.Errorf("Unexpected body %q", body)
+		}
+		if requests == 1 {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = srv.URL
+
+	now := time.Now()
+	var slept time.Duration
+	l := newRateLimiter(http.DefaultTransport)
+	l.now = func() time.Time { return now }
+	l.sleep = func(_ context.Context, d time.Duration) error {
+		slept += d
+		return nil
+	}
+
+	client := &http.Client{Transport: l}
+	resp, err := client.Post(srv.URL+"/repos/a/b/issues/1/comments", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	if requests != 2 {
+		t.Errorf("Unexpected number of requests %d", requests)
+	}
+	if slept != 30*time.Second {
+		t.Errorf("Unexpected wait %v", slept)
+	}
+}
+
+func TestRateLimiterThrottle(t *testing.T) {
+	now := time.Now()
+	var slept time.Duration
+	l := newRateLimiter(nil)
+	l.now = func() time.Time { return now }
+	l.sleep = func(_ context.Context, d time.Duration) error {
+		slept = d
+		return nil
+	}
+
+	cases := []struct {
+		remaining string
+		wait      time.Duration
+	}{
+		{"4000", 0},
+		{"99", time.Minute / 100},
+		{"0", time.Minute},
+	}
+	for _, tc := range cases {
+		l.update(&http.Response{Header: http.Header{
+			"X-Ratelimit-Remaining": []string{tc.remaining},
+			"X-Ratelimit-Reset":     []string{fmt.Sprint(now.Add(time.Minute).Unix())},
+		}})
+		// The reset time has second resolution
+		now = time.Unix(now.Unix(), 0)
+		slept = 0
+		if err := l.throttle(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if slept != tc.wait {
+			t.Errorf("Remaining %s: unexpected wait %v != %v", tc.remaining, slept, tc.wait)
+		}
+	}
+}
+
+func TestRateLimiterOtherHosts(t *testing.T) {
+	ok := &http.Response{StatusCode: 200, Header: http.Header{"X-Ratelimit-Remaining": []string{"0"}}}
+	l := newRateLimiter(fakeRoundTripper{resp: ok})
+	req, _ := http.NewRequest("GET", "https://build.example.com/status", nil)
+	for i := 0; i < 2; i++ {
+		if _, err := l.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l.remaining != -1 {
+		t.Errorf("Unexpected rate limit state %d", l.remaining)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -9,12 +11,83 @@ func noUserResponse(c comment) string {
 	return fmt.Sprintf("@%s: Couldn't retrieve your user information - not merging.", c.Sender.Login)
 }
 
-func thanksResponse(c comment, sha1 string) string {
-	return fmt.Sprintf(":ok_hand: Merged as %s. Thanks, @%s!", sha1, c.Issue.User.Login)
+func thanksResponse(c comment, sha1 string, retries map[string]int) string {
+	msg := fmt.Sprintf(":ok_hand: Merged as %s. Thanks, @%s!", sha1, c.Issue.User.Login)
+	if len(retries) > 0 {
+		contexts := make([]string, 0, len(retries))
+		for ctx := range retries {
+			contexts = append(contexts, ctx)
+		}
+		sort.Strings(contexts)
+		for i, ctx := range contexts {
+			contexts[i] = fmt.Sprintf("`%s` (%s)", ctx, plural(retries[ctx], "time"))
+		}
+		msg += "\n\nI retried some flaky checks along the way: " + strings.Join(contexts, ", ") + "."
+	}
+	return msg
 }
 
-func waitingResponse(c comment) string {
-	return fmt.Sprintf("@%s: Build status is `pending`. I'll wait until it goes green and then merge!", c.Sender.Login)
+func plural(n int, word string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, word)
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
+
+func fixedIssueResponse(c comment, sha1 string) string {
+	return fmt.Sprintf("Fixed by %s@%s, merged from %s#%d.", c.Repository.FullName, sha1, c.Repository.FullName, c.Issue.Number)
+}
+
+func missingAuthorResponse(c comment, err *missingAuthorError) string {
+	return fmt.Sprintf("@%s: %s <%s> is not listed in the AUTHORS file -- refusing to merge. Please add a line like `%s` to it.", c.Sender.Login, err.name, err.email, authorsFileEntry(user{Login: err.login, Name: err.name, Email: err.email}))
+}
+
+func waitingResponse(c comment, deadline time.Time) string {
+	return fmt.Sprintf("@%s: Build status is `pending`. I'll wait until it goes green and then merge! I'll give up if it hasn't by %s.", c.Sender.Login, deadline.UTC().Format("Mon Jan 2 15:04 MST"))
+}
+
+func scheduledResponse(c comment, reason string, at time.Time) string {
+	return fmt.Sprintf("@%s: I can't merge right now as %s. I'll try again at %s.", c.Sender.Login, reason, at.Format("Mon Jan 2 15:04 MST"))
+}
+
+func mergeWindowClosedResponse(c comment, reason string) string {
+	return fmt.Sprintf("@%s: I can't merge right now as %s, and I don't know when that will change -- refusing to merge.", c.Sender.Login, reason)
+}
+
+func freezeUsageResponse(c comment) string {
+	return fmt.Sprintf("@%s: Which branch? Say `freeze <branch> [reason]` or `unfreeze <branch>`.", c.Sender.Login)
+}
+
+func frozenResponse(c comment, f freeze) string {
+	msg := fmt.Sprintf("@%s: :snowflake: Froze `%s`; I won't merge anything to it until it's unfrozen.", c.Sender.Login, f.Branch)
+	if f.Reason != "" {
+		msg += " Reason: " + f.Reason
+	}
+	return msg
+}
+
+func unfrozenResponse(c comment, branch string) string {
+	return fmt.Sprintf("@%s: Unfroze `%s`; merges are back on.", c.Sender.Login, branch)
+}
+
+func notFrozenResponse(c comment, branch string) string {
+	return fmt.Sprintf("@%s: `%s` isn't frozen.", c.Sender.Login, branch)
+}
+
+func branchFrozenResponse(c comment, f freeze) string {
+	msg := fmt.Sprintf("@%s: `%s` is frozen by @%s", c.Sender.Login, f.Branch, f.Sender)
+	if f.Reason != "" {
+		msg += " (" + f.Reason + ")"
+	}
+	return msg + " -- refusing to merge."
+}
+
+func reviewsMissingResponse(c comment, missing []string) string {
+	msg := fmt.Sprintf("@%s: Branch protection requires reviews that are missing -- refusing to merge. Still needed:\n", c.Sender.Login)
+	for _, m := range missing {
+		msg += "\n- " + m
+	}
+	return msg
 }
 
 func badBuildResponse(c comment, status prState) string {
@@ -25,6 +98,10 @@ func timeoutResponse(c comment, timeout time.Duration) string {
 	return fmt.Sprintf("@%s: Patiently waited %v for the build status to turn green, but enough is enough.", c.Sender.Login, timeout)
 }
 
+func shutdownResponse(c comment) string {
+	return fmt.Sprintf("@%s: I'm being restarted and can't complete the merge right now. Please ask again in a little while.", c.Sender.Login)
+}
+
 func noAccessResponse(c comment) string {
 	return fmt.Sprintf(":hand: I'm sorry, @%s. I'm afraid I can't do that.", c.Sender.Login)
 }
@@ -41,6 +118,10 @@ func notMergingResponse(c comment) string {
 	return fmt.Sprintf("@%s: Preventing merge for the time being. Push a new revision to reset!", c.Sender.Login)
 }
 
+func cancelledResponse(c comment) string {
+	return fmt.Sprintf("@%s: The pending merge was cancelled by an operator.", c.Sender.Login)
+}
+
 func alreadyPendingResponse(c comment) string {
 	return fmt.Sprintf("@%s: There's already a merge pending for this PR.", c.Sender.Login)
 }
@@ -49,6 +130,64 @@ func lgtmResponse(c comment) string {
 	return fmt.Sprintf("@%s: Noted! Need another LGTM or explicit merge command.", c.Sender.Login)
 }
 
-func tcErrorResponse(c comment, err error) string {
-	return fmt.Sprintf("@%s: Triggered the build, but TC said `%v`. Maybe it worked, maybe it didn't.", c.Sender.Login, err)
+func ciErrorResponse(c comment, builds []triggeredBuild, err error) string {
+	errs, ok := err.(triggerErrors)
+	if !ok {
+		return fmt.Sprintf("@%s: Triggered the build, but CI said `%v`. Maybe it worked, maybe it didn't.", c.Sender.Login, err)
+	}
+
+	msg := fmt.Sprintf("@%s: Triggered the build, but CI said:\n\n", c.Sender.Login)
+	for _, e := range errs {
+		msg += fmt.Sprintf("- `%s`: `%v`\n", e.job, e.err)
+	}
+	if len(builds) > 0 {
+		msg += "\nThese builds were queued:\n\n" + buildList(builds)
+	}
+	return msg
+}
+
+func nothingToRebuildResponse(c comment) string {
+	return fmt.Sprintf("@%s: There are no matching checks to rebuild.", c.Sender.Login)
+}
+
+func unknownContextsResponse(c comment, contexts []string) string {
+	return fmt.Sprintf("@%s: I don't know which builds produce %s, so I can't rebuild them.", c.Sender.Login, quotedList(contexts))
+}
+
+func rebuildingResponse(c comment, contexts, unknown []string, builds []triggeredBuild) string {
+	msg := fmt.Sprintf("@%s: Rebuilding.", c.Sender.Login)
+	if len(contexts) > 0 {
+		msg = fmt.Sprintf("@%s: Rebuilding %s.", c.Sender.Login, quotedList(contexts))
+	}
+	if len(unknown) > 0 {
+		msg += fmt.Sprintf(" I don't know which builds produce %s, so those are left alone.", quotedList(unknown))
+	}
+	if len(builds) > 0 {
+		msg += "\n\n" + buildList(builds)
+	}
+	return msg
+}
+
+func buildList(builds []triggeredBuild) string {
+	var msg string
+	for _, b := range builds {
+		if b.URL != "" {
+			msg += fmt.Sprintf("- `%s`: [%s](%s)\n", b.Job, b.ID, b.URL)
+		} else {
+			msg += fmt.Sprintf("- `%s`: %s\n", b.Job, b.ID)
+		}
+	}
+	return msg
+}
+
+func quotedList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = "`" + item + "`"
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func noCIResponse(c comment) string {
+	return fmt.Sprintf("@%s: I don't know how to trigger builds for this repository.", c.Sender.Login)
 }
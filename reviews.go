@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Who may merge without the review requirements from branch protection
+// being met.
+type reviewConfig struct {
+	// Rules, as for permissions, for the users whose merge commands
+	// override the review requirements.
+	Override []string `json:"override"`
+}
+
+type review struct {
+	User struct {
+		Login string
+	}
+	State    string
+	CommitID string `json:"commit_id"`
+}
+
+// getReviews returns the reviews of the PR, oldest first.
+func getReviews(ctx context.Context, repo string, number int, username, token string) ([]review, error) {
+	var res []review
+	for page := 1; ; page++ {
+		var reviews []review
+		u := fmt.Sprintf("%s/repos/%s/pulls/%d/reviews?per_page=100&page=%d", githubAPIURL, repo, number, page)
+		if err := githubGet(ctx, u, username, token, &reviews); err != nil {
+			return nil, err
+		}
+		res = append(res, reviews...)
+		if len(reviews) < 100 {
+			return res, nil
+		}
+	}
+}
+
+// approvers returns the users whose latest review approves the PR. When
+// dismissStale is set, only approvals of the current head count.
+func approvers(reviews []review, head string, dismissStale bool) []string {
+	latest := make(map[string]review)
+	for _, r := range reviews {
+		switch r.State {
+		case "APPROVED", "CHANGES_REQUESTED", "DISMISSED":
+			latest[r.User.Login] = r
+		}
+	}
+
+	var res []string
+	for login, r := range latest {
+		if r.State != "APPROVED" || dismissStale && r.CommitID != head {
+			continue
+		}
+		res = append(res, login)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// getChangedFiles returns the names of the files changed by the PR.
+func getChangedFiles(ctx context.Context, repo string, number int, username, token string) ([]string, error) {
+	var res []string
+	for page := 1; ; page++ {
+		var files []struct {
+			Filename string
+		}
+		u := fmt.Sprintf("%s/repos/%s/pulls/%d/files?per_page=100&page=%d", githubAPIURL, repo, number, page)
+		if err := githubGet(ctx, u, username, token, &files); err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			res = append(res, f.Filename)
+		}
+		if len(files) < 100 {
+			return res, nil
+		}
+	}
+}
+
+// The places GitHub looks for the CODEOWNERS file, in order.
+var codeOwnersPaths = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+type codeOwnersRule struct {
+	pattern *regexp.Regexp
+	owners  []string
+}
+
+type codeOwners []codeOwnersRule
+
+// getCodeOwners returns the CODEOWNERS of the branch, or nil if there is
+// no such file.
+func getCodeOwners(ctx context.Context, repo, branch, username, token string) (codeOwners, error) {
+	for _, path := range codeOwnersPaths {
+		var res struct {
+			Content  string
+			Encoding string
+		}
+		u := fmt.Sprintf("%s/repos/%s/contents/%s?ref=%s", githubAPIURL, repo, path, url.QueryEscape(branch))
+		err := githubGet(ctx, u, username, token, &res)
+		if err == errNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if res.Encoding != "base64" {
+			return nil, fmt.Errorf("%s: unexpected encoding %q", path, res.Encoding)
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.Replace(res.Content, "\n", "", -1))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return parseCodeOwners(string(data)), nil
+	}
+	return nil, nil
+}
+
+func parseCodeOwners(data string) codeOwners {
+	var res codeOwners
+	sc := bufio.NewScanner(strings.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		re, err := codeOwnersPattern(fields[0])
+		if err != nil {
+			continue
+		}
+		res = append(res, codeOwnersRule{pattern: re, owners: fields[1:]})
+	}
+	return res
+}
+
+// codeOwnersPattern converts a gitignore style pattern to a regexp
+// matching file names.
+func codeOwnersPattern(pat string) (*regexp.Regexp, error) {
+	dir := strings.HasSuffix(pat, "/")
+	pat = strings.TrimSuffix(pat, "/")
+	anchored := strings.Contains(pat, "/")
+	pat = strings.TrimPrefix(pat, "/")
+
+	var re strings.Builder
+	if anchored {
+		re.WriteString("^")
+	} else {
+		re.WriteString("^(.*/)?")
+	}
+	for i := 0; i < len(pat); i++ {
+		switch {
+		case strings.HasPrefix(pat[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pat[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case pat[i] == '*':
+			re.WriteString("[^/]*")
+		case pat[i] == '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		}
+	}
+	if dir {
+		re.WriteString("/.*$")
+	} else {
+		re.WriteString("(/.*)?$")
+	}
+	return regexp.Compile(re.String())
+}
+
+// owners returns the owners of the file. The last matching pattern wins.
+func (c codeOwners) owners(file string) []string {
+	for i := len(c) - 1; i >= 0; i-- {
+		if c[i].pattern.MatchString(file) {
+			return c[i].owners
+		}
+	}
+	return nil
+}
+
+// missingReviews returns the review requirements of the protection that
+// the PR does not meet, as descriptions suitable for a comment.
+func (h *handler) missingReviews(ctx context.Context, repo string, number int, p pr, prot protection) ([]string, error) {
+	reviews, err := getReviews(ctx, repo, number, h.username, h.token)
+	if err != nil {
+		return nil, err
+	}
+	// Like GitHub, only count approvals by those with write access.
+	var approved []string
+	for _, login := range approvers(reviews, p.headSHA(), prot.DismissStale) {
+		level, err := h.permissionLevel(ctx, repo, login)
+		if err != nil {
+			return nil, err
+		}
+		if permissionRank(level) >= permissionRank("write") {
+			approved = append(approved, login)
+		}
+	}
+
+	var missing []string
+	if len(approved) < prot.Reviews {
+		missing = append(missing, fmt.Sprintf("%s (%d so far)", plural(prot.Reviews, "approving review"), len(approved)))
+	}
+
+	if prot.CodeOwners {
+		owners, err := getCodeOwners(ctx, repo, p.baseRef(), h.username, h.token)
+		if err != nil {
+			return nil, err
+		}
+		files, err := getChangedFiles(ctx, repo, number, h.username, h.token)
+		if err != nil {
+			return nil, err
+		}
+
+		unapproved := make(map[string]bool)
+		for _, file := range files {
+			fileOwners := owners.owners(file)
+			if len(fileOwners) > 0 && !h.ownerApproved(ctx, repo, fileOwners, approved) {
+				unapproved[strings.Join(fileOwners, " ")] = true
+			}
+		}
+		var owned []string
+		for o := range unapproved {
+			owned = append(owned, o)
+		}
+		sort.Strings(owned)
+		for _, o := range owned {
+			missing = append(missing, "approval from code owner "+o)
+		}
+	}
+
+	return missing, nil
+}
+
+// ownerApproved returns true if any of the approvers is one of the
+// owners, given as @login or @org/team. Owners given by email address
+// can't be matched to users and never approve.
+func (h *handler) ownerApproved(ctx context.Context, repo string, owners, approved []string) bool {
+	for _, owner := range owners {
+		if !strings.HasPrefix(owner, "@") {
+			continue
+		}
+		owner = owner[1:]
+		for _, login := range approved {
+			if !strings.Contains(owner, "/") {
+				if strings.EqualFold(owner, login) {
+					return true
+				}
+				continue
+			}
+			ok, err := h.isTeamMember(ctx, owner, login)
+			if err != nil {
+				logger(ctx).Error("Checking team membership", "login", login, "team", owner, "error", err)
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// refuseUnreviewed checks the review requirements of the branch
+// protection, as we'd bypass them when pushing the merge ourselves. It
+// returns true if the merge should not go ahead, after saying so.
+func (h *handler) refuseUnreviewed(ctx context.Context, c comment, p pr, e *auditEntry) bool {
+	repo := c.Repository.FullName
+	prot, err := h.branchProtection(ctx, p)
+	if err != nil {
+		logger(ctx).Error("Getting branch protection", "error", err)
+		c.post(ctx, errorResponse(c, "checking branch protection: "+err.Error()), h.username, h.token)
+		e.Result = auditFailed + ": checking branch protection"
+		return true
+	}
+	if prot.Reviews == 0 && !prot.CodeOwners {
+		return false
+	}
+
+	missing, err := h.missingReviews(ctx, repo, c.Issue.Number, p, prot)
+	if err != nil {
+		logger(ctx).Error("Checking reviews", "error", err)
+		c.post(ctx, errorResponse(c, "checking reviews: "+err.Error()), h.username, h.token)
+		e.Result = auditFailed + ": checking reviews"
+		return true
+	}
+	if len(missing) == 0 {
+		return false
+	}
+
+	if rc := h.config.repo(repo).Reviews; rc != nil && h.matchesAny(ctx, repo, c.Sender.Login, rc.Override) {
+		logger(ctx).Info("Overriding review requirements", "missing", missing)
+		return false
+	}
+
+	c.post(ctx, reviewsMissingResponse(c, missing), h.username, h.token)
+	e.Result = auditRefused + ": reviews"
+	logger(ctx).Info("Refusing merge without required reviews", "missing", missing)
+	return true
+}
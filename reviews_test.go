@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCodeOwners(t *testing.T) {
+	owners := parseCodeOwners(`
+# Default owners
+*            @a/everyone
+*.go         @gopher # Go code
+/docs/       @writer
+build/       @builder
+/cmd/*/main.go @cmd
+**/testdata  @tester
+`)
+
+	cases := []struct {
+		file   string
+		owners []string
+	}{
+		{"README.md", []string{"@a/everyone"}},
+		{"main.go", []string{"@gopher"}},
+		{"lib/x/y.go", []string{"@gopher"}},
+		{"docs/index.md", []string{"@writer"}},
+		{"lib/docs/index.md", []string{"@a/everyone"}},
+		{"build/Makefile", []string{"@builder"}},
+		{"lib/build/Makefile", []string{"@builder"}},
+		{"cmd/foo/main.go", []string{"@cmd"}},
+		{"cmd/foo/bar/main.go", []string{"@gopher"}},
+		{"lib/testdata/x.txt", []string{"@tester"}},
+		{"testdata/x.txt", []string{"@tester"}},
+	}
+	for _, tc := range cases {
+		if o := owners.owners(tc.file); !reflect.DeepEqual(o, tc.owners) {
+			t.Errorf("%s: %v != %v", tc.file, o, tc.owners)
+		}
+	}
+}
+
+func TestApprovers(t *testing.T) {
+	r := func(login, state, sha string) review {
+		var rv review
+		rv.User.Login = login
+		rv.State = state
+		rv.CommitID = sha
+		return rv
+	}
+	reviews := []review{
+		r("a", "APPROVED", "old"),
+		r("b", "APPROVED", "old"),
+		r("b", "CHANGES_REQUESTED", "new"),
+		r("c", "CHANGES_REQUESTED", "old"),
+		r("c", "APPROVED", "new"),
+		r("c", "COMMENTED", "new"),
+		r("d", "APPROVED", "old"),
+		r("d", "DISMISSED", "old"),
+	}
+
+	if a := approvers(reviews, "new", false); !reflect.DeepEqual(a, []string{"a", "c"}) {
+		t.Errorf("Unexpected approvers %v", a)
+	}
+	if a := approvers(reviews, "new", true); !reflect.DeepEqual(a, []string{"c"}) {
+		t.Errorf("Unexpected approvers with stale reviews dismissed %v", a)
+	}
+}
+
+func TestRefuseUnreviewed(t *testing.T) {
+	var comments []string
+	gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/repos/a/b/branches/main/protection":
+			w.Write([]byte(`{"required_pull_request_reviews": {"required_approving_review_count": 2, "require_code_owner_reviews": true}}`))
+		case r.URL.Path == "/repos/a/b/branches/broken/protection":
+			http.Error(w, "oops", http.StatusInternalServerError)
+		case r.URL.Path == "/repos/a/b/pulls/1/reviews":
+			w.Write([]byte(`[{"user": {"login": "jb"}, "state": "APPROVED", "commit_id": "sha"}, {"user": {"login": "drive-by"}, "state": "APPROVED", "commit_id": "sha"}, {"user": {"login": "writer"}, "state": "APPROVED", "commit_id": "sha"}]`))
+		case r.URL.Path == "/repos/a/b/collaborators/jb/permission":
+			w.Write([]byte(`{"permission": "write"}`))
+		case r.URL.Path == "/repos/a/b/collaborators/writer/permission":
+			// Code owner, but can't approve
+			w.Write([]byte(`{"permission": "read"}`))
+		case r.URL.Path == "/repos/a/b/pulls/1/files":
+			w.Write([]byte(`[{"filename": "main.go"}, {"filename": "docs/index.md"}]`))
+		case r.URL.Path == "/repos/a/b/contents/.github/CODEOWNERS" && r.URL.Query().Get("ref") == "main":
+			json.NewEncoder(w).Encode(map[string]string{
+				"encoding": "base64",
+				"content":  base64.StdEncoding.EncodeToString([]byte("*.go @jb\n/docs/ @writer\n")),
+			})
+		case r.Method == "POST":
+			bs, _ := ioutil.ReadAll(r.Body)
+			var v map[string]string
+			json.Unmarshal(bs, &v)
+			comments = append(comments, v["body"])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer gh.Close()
+	defer func(orig string) { githubAPIURL = orig }(githubAPIURL)
+	githubAPIURL = gh.URL
+
+	cfg := &config{Repos: map[string]repoConfig{"a/b": {Reviews: &reviewConfig{Override: []string{"user:boss"}}}}}
+	h := newHandler(nil, "mergebot", "token", false, nil, "", "", messageFromCommit, authorsIgnore, cfg, newPermCache(time.Minute, time.Minute), newProtectionCache(time.Minute), nil, nil)
+
+	var p pr
+	p.Base.Ref = "main"
+	p.Base.Repo.FullName = "a/b"
+	p.Head.SHA = "sha"
+
+	e := auditEntry{}
+	if !h.refuseUnreviewed(context.Background(), newComment("a/b", 1, "jb", "@mergebot merge"), p, &e) || e.Result != auditRefused+": reviews" {
+		t.Errorf("Merge not refused: %+v", e)
+	}
+	if len(comments) != 1 || !strings.Contains(comments[0], "2 approving reviews (1 so far)") || !strings.Contains(comments[0], "code owner @writer") || strings.Contains(comments[0], "@jb\n") {
+		t.Errorf("Unexpected comments %q", comments)
+	}
+
+	// The override applies to the configured users
+	e = auditEntry{}
+	if h.refuseUnreviewed(context.Background(), newComment("a/b", 1, "boss", "@mergebot merge"), p, &e) {
+		t.Errorf("Merge refused despite override: %+v", e)
+	}
+
+	// Branches without review requirements are fine
+	p.Base.Ref = "feature"
+	if h.refuseUnreviewed(context.Background(), newComment("a/b", 1, "jb", "@mergebot merge"), p, &e) {
+		t.Errorf("Merge to unprotected branch refused: %+v", e)
+	}
+
+	// Merges are refused when the requirements can't be read
+	p.Base.Ref = "broken"
+	comments = nil
+	e = auditEntry{}
+	if !h.refuseUnreviewed(context.Background(), newComment("a/b", 1, "jb", "@mergebot merge"), p, &e) || e.Result != auditFailed+": checking branch protection" {
+		t.Errorf("Merge not refused without branch protection: %+v", e)
+	}
+	if len(comments) != 1 || !strings.Contains(comments[0], "checking branch protection") {
+		t.Errorf("Unexpected comments %q", comments)
+	}
+}
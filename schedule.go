@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The scheduleConfig limits when merges may happen in a repository. Merges
+// happen only inside one of the windows, if any are given, and never
+// during a freeze.
+//
+//	"schedule": {
+//	  "timezone": "Europe/Stockholm",
+//	  "windows": ["Mon-Thu 09:00-17:00", "Fri 09:00-12:00"],
+//	  "freezes": [
+//	    {"from": "2017-06-01T00:00:00Z", "until": "2017-06-06T00:00:00Z", "reason": "Release weekend"}
+//	  ]
+//	}
+type scheduleConfig struct {
+	TimeZone string         `json:"timezone"` // IANA name, default UTC
+	Windows  []string       `json:"windows"`  // days and time range, see parseWindow
+	Freezes  []freezePeriod `json:"freezes"`
+}
+
+type freezePeriod struct {
+	From   time.Time `json:"from"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+// A mergeWindow is a time range on some days of the week.
+type mergeWindow struct {
+	days       [7]bool       // indexed by time.Weekday
+	start, end time.Duration // since midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseWindow parses windows like "Mon-Fri 09:00-17:00", "Sat,Sun
+// 10:00-14:00" or "* 08:00-20:00". The end time may be 24:00.
+func parseWindow(s string) (mergeWindow, error) {
+	var w mergeWindow
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("window %q: expected days and time range", s)
+	}
+
+	if fields[0] == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	} else {
+		for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+			from, to, isRange := strings.Cut(part, "-")
+			first, ok1 := weekdays[from]
+			last, ok2 := weekdays[to]
+			if !isRange {
+				last, ok2 = first, ok1
+			}
+			if !ok1 || !ok2 {
+				return w, fmt.Errorf("window %q: unknown days %q", s, part)
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	from, to, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return w, fmt.Errorf("window %q: expected time range like 09:00-17:00", s)
+	}
+	var err error
+	if w.start, err = parseClock(from); err != nil {
+		return w, fmt.Errorf("window %q: %v", s, err)
+	}
+	if w.end, err = parseClock(to); err != nil {
+		return w, fmt.Errorf("window %q: %v", s, err)
+	}
+	if w.end <= w.start {
+		return w, fmt.Errorf("window %q: ends before it starts", s)
+	}
+	return w, nil
+}
+
+// parseClock parses a time of day like 09:30 as the duration since
+// midnight.
+func parseClock(s string) (time.Duration, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || h < 0 || h > 24 || m < 0 || m > 59 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("bad time of day %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+func (w mergeWindow) contains(t time.Time) bool {
+	// Wall clock time, not elapsed time, to do the right thing on days
+	// with daylight saving time changes.
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	return w.days[t.Weekday()] && since >= w.start && since < w.end
+}
+
+// A schedule is the parsed form of a scheduleConfig.
+type schedule struct {
+	loc     *time.Location
+	windows []mergeWindow
+	freezes []freezePeriod
+}
+
+func newSchedule(c *scheduleConfig) (*schedule, error) {
+	s := &schedule{loc: time.UTC, freezes: c.Freezes}
+	if c.TimeZone != "" {
+		loc, err := time.LoadLocation(c.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %v", err)
+		}
+		s.loc = loc
+	}
+	for _, ws := range c.Windows {
+		w, err := parseWindow(ws)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, w)
+	}
+	for _, f := range c.Freezes {
+		if !f.Until.After(f.From) {
+			return nil, fmt.Errorf("freeze %q ends before it starts", f.Reason)
+		}
+	}
+	return s, nil
+}
+
+// open returns whether merges may happen at the given time, and if not,
+// why not.
+func (s *schedule) open(t time.Time) (bool, string) {
+	for _, f := range s.freezes {
+		if !t.Before(f.From) && t.Before(f.Until) {
+			reason := "merges are frozen"
+			if f.Reason != "" {
+				reason += " (" + f.Reason + ")"
+			}
+			return false, reason
+		}
+	}
+	if len(s.windows) == 0 {
+		return true, ""
+	}
+	t = t.In(s.loc)
+	for _, w := range s.windows {
+		if w.contains(t) {
+			return true, ""
+		}
+	}
+	return false, "we're outside the merge window"
+}
+
+// scheduleHorizon is how far ahead nextOpen looks.
+const scheduleHorizon = 60 * 24 * time.Hour
+
+// nextOpen returns the first time at or after t when merges may happen,
+// or the zero time if that's not within the scheduleHorizon.
+func (s *schedule) nextOpen(t time.Time) time.Time {
+	if ok, _ := s.open(t); ok {
+		return t
+	}
+
+	// Merges may start at the start of a window or the end of a freeze, so
+	// those are the candidates.
+	var best time.Time
+	consider := func(c time.Time) {
+		if c.After(t) && c.Sub(t) <= scheduleHorizon && (best.IsZero() || c.Before(best)) {
+			if ok, _ := s.open(c); ok {
+				best = c
+			}
+		}
+	}
+	for _, f := range s.freezes {
+		consider(f.Until)
+	}
+	lt := t.In(s.loc)
+	for d := 0; d <= int(scheduleHorizon/(24*time.Hour)); d++ {
+		day := time.Date(lt.Year(), lt.Month(), lt.Day()+d, 0, 0, 0, 0, s.loc)
+		for _, w := range s.windows {
+			if w.days[day.Weekday()] {
+				consider(time.Date(day.Year(), day.Month(), day.Day(), 0, int(w.start/time.Minute), 0, 0, s.loc))
+			}
+		}
+		if !best.IsZero() && best.Sub(t) < time.Duration(d)*24*time.Hour {
+			break
+		}
+	}
+	return best
+}
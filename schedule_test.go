@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	cases := []struct {
+		in    string
+		days  string // initials of the days, Sunday first
+		start time.Duration
+		end   time.Duration
+		ok    bool
+	}{
+		{"Mon-Fri 09:00-17:00", ".MTWTF.", 9 * time.Hour, 17 * time.Hour, true},
+		{"sat,SUN 10:30-24:00", "S.....S", 10*time.Hour + 30*time.Minute, 24 * time.Hour, true},
+		{"Fri-Mon 00:00-01:00", "SM...FS", 0, time.Hour, true},
+		{"* 08:00-20:00", "SMTWTFS", 8 * time.Hour, 20 * time.Hour, true},
+		{"Mon 17:00-09:00", "", 0, 0, false},
+		{"Mon 09:00", "", 0, 0, false},
+		{"Mon 09:00-25:00", "", 0, 0, false},
+		{"Someday 09:00-17:00", "", 0, 0, false},
+		{"09:00-17:00", "", 0, 0, false},
+	}
+	for _, tc := range cases {
+		w, err := parseWindow(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: unexpected error %v", tc.in, err)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		days := []byte(".......")
+		for d, ok := range w.days {
+			if ok {
+				days[d] = "SMTWTFS"[d]
+			}
+		}
+		if string(days) != tc.days || w.start != tc.start || w.end != tc.end {
+			t.Errorf("%q: unexpected window %s %v-%v", tc.in, days, w.start, w.end)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	sched, err := newSchedule(&scheduleConfig{
+		Windows: []string{"Mon-Fri 09:00-17:00"},
+		Freezes: []freezePeriod{
+			{From: time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC), Until: time.Date(2017, 6, 6, 10, 0, 0, 0, time.UTC), Reason: "Release"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sched.loc = time.FixedZone("CEST", 2*3600)
+
+	// 2017-05-29 is a Monday
+	cases := []struct {
+		at   time.Time
+		open bool
+		next time.Time
+	}{
+		// Monday morning, before and inside the window
+		{time.Date(2017, 5, 29, 6, 59, 0, 0, time.UTC), false, time.Date(2017, 5, 29, 7, 0, 0, 0, time.UTC)},
+		{time.Date(2017, 5, 29, 7, 0, 0, 0, time.UTC), true, time.Date(2017, 5, 29, 7, 0, 0, 0, time.UTC)},
+		// Wednesday evening, until Thursday morning
+		{time.Date(2017, 5, 31, 15, 0, 0, 0, time.UTC), false, time.Date(2017, 6, 1, 7, 0, 0, 0, time.UTC)},
+		// Thursday, frozen until Tuesday 10:00 UTC, which is inside the window
+		{time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC), false, time.Date(2017, 6, 6, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		open, reason := sched.open(tc.at)
+		if open != tc.open || open != (reason == "") {
+			t.Errorf("%v: unexpected open=%v (%q)", tc.at, open, reason)
+		}
+		if next := sched.nextOpen(tc.at); !next.Equal(tc.next) {
+			t.Errorf("%v: next open %v, expected %v", tc.at, next, tc.next)
+		}
+	}
+
+	if _, reason := sched.open(time.Date(2017, 6, 2, 8, 0, 0, 0, time.UTC)); reason != "merges are frozen (Release)" {
+		t.Errorf("Unexpected reason %q", reason)
+	}
+}
+
+func TestScheduleForeverFrozen(t *testing.T) {
+	t0 := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	sched, err := newSchedule(&scheduleConfig{
+		Freezes: []freezePeriod{{From: t0, Until: t0.AddDate(1, 0, 0)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := sched.nextOpen(t0); !next.IsZero() {
+		t.Errorf("Unexpected next open %v", next)
+	}
+
+	if _, err := newSchedule(&scheduleConfig{TimeZone: "Nowhere/Special"}); err == nil {
+		t.Error("Unexpected nil error for bad time zone")
+	}
+}
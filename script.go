@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 type script struct {
@@ -56,7 +58,11 @@ func (s *script) runCmd(cmd *exec.Cmd) string {
 	}
 	fmt.Fprintln(s.output, "$", cmdLine.String())
 
+	t0 := time.Now()
 	bs, err := cmd.CombinedOutput()
+	if len(cmd.Args) > 1 && filepath.Base(cmd.Args[0]) == "git" {
+		observeSince(metricGitDuration.WithLabelValues(cmd.Args[1]), t0)
+	}
 	if err != nil {
 		s.err = err
 	}
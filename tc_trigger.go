@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
@@ -13,47 +17,119 @@ const tcBuildTemplate = `<build branchName="%s">
 	<comment><text>Triggered by mergebot</text></comment>
 </build>`
 
-var (
+// The teamcityTrigger queues the given build configurations for the PR
+// branch.
+type teamcityTrigger struct {
+	url      string
+	user     string
+	password string
+	buildIDs []string
+}
+
+// teamcityFromEnv returns the TeamCity configuration given in the
+// environment, used for repositories without a CI configuration, or nil.
+func teamcityFromEnv() *ciConfig {
 	// export TEAMCITY_SERVER=build2.syncthing.net
 	// export TEAMCITY_USER=machine
 	// export TEAMCITY_PASSWORD=p4ssw0rd
 	// export TEAMCITY_BUILD_IDS=Syncthing_BuildLinuxCross,Syncthing_BuildMac,Syncthing_BuildWindows,Syncthing_CheckAuthors,Syncthing_CheckCorrectness
-	tcServer   = os.Getenv("TEAMCITY_SERVER")
-	tcUser     = os.Getenv("TEAMCITY_USER")
-	tcPassword = os.Getenv("TEAMCITY_PASSWORD")
-	tcBuildIDs = strings.Split(os.Getenv("TEAMCITY_BUILD_IDS"), ",")
-)
+	// export TEAMCITY_CONTEXTS="Build (Linux)=Syncthing_BuildLinuxCross,Check Authors=Syncthing_CheckAuthors"
+	server := os.Getenv("TEAMCITY_SERVER")
+	if server == "" {
+		return nil
+	}
+	cfg := &ciConfig{
+		Type:     ciTeamCity,
+		URL:      "https://" + server,
+		User:     os.Getenv("TEAMCITY_USER"),
+		Password: os.Getenv("TEAMCITY_PASSWORD"),
+		Jobs:     strings.Split(os.Getenv("TEAMCITY_BUILD_IDS"), ","),
+	}
+	if v := os.Getenv("TEAMCITY_CONTEXTS"); v != "" {
+		cfg.Contexts = make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			if ctx, id, ok := strings.Cut(pair, "="); ok {
+				cfg.Contexts[strings.TrimSpace(ctx)] = strings.TrimSpace(id)
+			}
+		}
+	}
+	return cfg
+}
 
-func tcTriggerBuild(pr int) error {
-	branch := fmt.Sprintf("pull/%d", pr)
-	var firstError error
-	for _, buildID := range tcBuildIDs {
+func (t *teamcityTrigger) TriggerBuild(ctx context.Context, p pr, buildIDs []string) ([]triggeredBuild, error) {
+	if len(buildIDs) == 0 {
+		buildIDs = t.buildIDs
+	}
+	branch := fmt.Sprintf("pull/%d", p.Number)
+	var builds []triggeredBuild
+	var errs triggerErrors
+	for _, buildID := range buildIDs {
 		data := fmt.Sprintf(tcBuildTemplate, branch, buildID)
-		if err := tcPostBuildRequest(data); err != nil && firstError == nil {
-			firstError = err
+		qb, err := t.postBuildRequest(ctx, data)
+		if err != nil {
+			errs = errs.add(buildID, err)
+			continue
 		}
+		builds = append(builds, triggeredBuild{Job: buildID, ID: "#" + qb.ID.String(), URL: qb.WebURL})
 	}
-	return firstError
+	return builds, errs.err()
+}
+
+// tcQueuedBuild is the part of the TeamCity response to queueing a build
+// we care about. TeamCity answers in XML or JSON depending on its mood and
+// the Accept header; the attribute and field names are the same.
+type tcQueuedBuild struct {
+	ID          json.Number `xml:"id,attr" json:"id"`
+	BuildTypeID string      `xml:"buildTypeId,attr" json:"buildTypeId"`
+	State       string      `xml:"state,attr" json:"state"`
+	WebURL      string      `xml:"webUrl,attr" json:"webUrl"`
 }
 
-func tcPostBuildRequest(data string) error {
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://%s/httpAuth/app/rest/buildQueue", tcServer), strings.NewReader(data))
+func (t *teamcityTrigger) postBuildRequest(ctx context.Context, data string) (tcQueuedBuild, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url+"/httpAuth/app/rest/buildQueue", strings.NewReader(data))
 	if err != nil {
-		return err
+		return tcQueuedBuild{}, err
 	}
 
-	req.SetBasicAuth(tcUser, tcPassword)
+	req.SetBasicAuth(t.user, t.password)
 	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("Accept", "application/json, application/xml;q=0.9")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return err
+		return tcQueuedBuild{}, err
 	}
 	defer resp.Body.Close()
 
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return tcQueuedBuild{}, err
+	}
 	if resp.StatusCode != http.StatusOK {
-		return errors.New(resp.Status)
+		return tcQueuedBuild{}, tcError(resp.Status, bs)
+	}
+
+	var qb tcQueuedBuild
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		err = json.Unmarshal(bs, &qb)
+	} else {
+		err = xml.Unmarshal(bs, &qb)
 	}
+	if err != nil {
+		return tcQueuedBuild{}, fmt.Errorf("parsing response: %v", err)
+	}
+	return qb, nil
+}
 
-	return nil
+// tcError returns an error with the status and the first line of the
+// response body, which is where TeamCity explains what went wrong.
+func tcError(status string, body []byte) error {
+	msg := strings.TrimSpace(string(body))
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	if msg == "" {
+		return errors.New(status)
+	}
+	return fmt.Errorf("%s: %s", status, msg)
 }
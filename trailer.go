@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A trailer is a "Key: value" line at the end of a commit message, like
+// Signed-off-by or GitHub-Pull-Request.
+type trailer struct {
+	key   string
+	value string
+}
+
+type trailers []trailer
+
+var trailerLineRe = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*):\s+(\S.*)$`)
+
+// The canonical spelling of known trailer keys, in the order they are
+// rendered. Unknown keys are rendered after these, as written and in the
+// order they were added.
+var trailerOrder = []string{
+	"GitHub-Pull-Request",
+	"Fixes",
+	"LGTM",
+	"Reviewed-by",
+	"Co-authored-by",
+	"Signed-off-by",
+	"Skip-Check",
+}
+
+// normalizeTrailerKey returns the canonical spelling of the given key if
+// it's a known one, so that "signed-off-by" and "Signed-Off-By" are
+// rendered the same. Other keys are kept as written, as tools may expect
+// them spelled just so; keys are compared ignoring case either way.
+func normalizeTrailerKey(key string) string {
+	for _, known := range trailerOrder {
+		if strings.EqualFold(key, known) {
+			return known
+		}
+	}
+	return key
+}
+
+func trailerRank(key string) int {
+	for i, known := range trailerOrder {
+		if key == known {
+			return i
+		}
+	}
+	return len(trailerOrder)
+}
+
+// parseTrailers splits a commit message into the text and the trailer
+// block, if any. The trailer block is the last paragraph of the message,
+// provided that it is not also the first and that every line in it is a
+// trailer or a continuation of one.
+func parseTrailers(msg string) (string, trailers) {
+	msg = strings.TrimSpace(strings.Replace(msg, "\r\n", "\n", -1))
+	idx := strings.LastIndex(msg, "\n\n")
+	if idx < 0 {
+		return msg, nil
+	}
+
+	var lines trailers
+	for _, line := range strings.Split(msg[idx+2:], "\n") {
+		if m := trailerLineRe.FindStringSubmatch(line); m != nil {
+			lines = append(lines, trailer{m[1], m[2]})
+			continue
+		}
+		if len(lines) > 0 && strings.IndexAny(line, " \t") == 0 {
+			// Continuation of the previous trailer value
+			lines[len(lines)-1].value += " " + strings.TrimSpace(line)
+			continue
+		}
+		// Not a trailer block
+		return msg, nil
+	}
+
+	var res trailers
+	for _, t := range lines {
+		res = res.add(t.key, t.value)
+	}
+	return strings.TrimSpace(msg[:idx]), res
+}
+
+// parseFields returns every "Key: value" line in the given text, wherever
+// it occurs. This is used for commands given in comments, where the fields
+// are not necessarily at the end.
+func parseFields(text string) trailers {
+	var res trailers
+	for _, line := range strings.Split(text, "\n") {
+		if m := trailerLineRe.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			res = res.add(m[1], m[2])
+		}
+	}
+	return res
+}
+
+// add returns the trailers with the given key and value appended, unless
+// that exact trailer is already present.
+func (ts trailers) add(key, value string) trailers {
+	key = normalizeTrailerKey(key)
+	value = strings.TrimSpace(value)
+	if key == "" || value == "" {
+		return ts
+	}
+	for _, t := range ts {
+		if strings.EqualFold(t.key, key) && t.value == value {
+			return ts
+		}
+	}
+	return append(ts, trailer{key, value})
+}
+
+// remove returns the trailers without those with the given key.
+func (ts trailers) remove(key string) trailers {
+	var res trailers
+	for _, t := range ts {
+		if !strings.EqualFold(t.key, key) {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// values returns all values for the given key.
+func (ts trailers) values(key string) []string {
+	var res []string
+	for _, t := range ts {
+		if strings.EqualFold(t.key, key) {
+			res = append(res, t.value)
+		}
+	}
+	return res
+}
+
+// String renders the trailers in the canonical order, one per line.
+func (ts trailers) String() string {
+	sorted := make(trailers, len(ts))
+	copy(sorted, ts)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return trailerRank(sorted[a].key) < trailerRank(sorted[b].key)
+	})
+
+	b := new(bytes.Buffer)
+	for _, t := range sorted {
+		b.WriteString(t.key)
+		b.WriteString(": ")
+		b.WriteString(t.value)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// withTrailers returns the commit message text with the trailers appended
+// as a block of their own.
+func withTrailers(text string, ts trailers) string {
+	text = strings.TrimSpace(text)
+	if len(ts) == 0 {
+		return text + "\n"
+	}
+	return text + "\n\n" + ts.String()
+}
+
+func fieldValues(message, field string) []string {
+	var res []string
+	for _, value := range parseFields(message).values(field) {
+		res = append(res, strings.Fields(value)...)
+	}
+	return res
+}
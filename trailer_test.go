@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTrailers(t *testing.T) {
+	cases := []struct {
+		msg      string
+		text     string
+		trailers trailers
+	}{
+		{"lib: Fix thing", "lib: Fix thing", nil},
+		{"Fixes: #12", "Fixes: #12", nil},
+		{"lib: Fix thing\n\nSee https://example.com/", "lib: Fix thing\n\nSee https://example.com/", nil},
+		{"lib: Fix thing\n\nhttps://example.com/", "lib: Fix thing\n\nhttps://example.com/", nil},
+		{
+			"lib: Fix thing\n\nSome text.\n\nsigned-off-by: A <a@example.com>\nFixes: #12\n",
+			"lib: Fix thing\n\nSome text.",
+			trailers{{"Signed-off-by", "A <a@example.com>"}, {"Fixes", "#12"}},
+		},
+		{
+			"lib: Fix thing\n\nLGTM: a,\n  b\nLGTM: a,\n  b",
+			"lib: Fix thing",
+			trailers{{"LGTM", "a, b"}},
+		},
+		{
+			"lib: Fix thing\n\nFixes: #12\nNot a trailer",
+			"lib: Fix thing\n\nFixes: #12\nNot a trailer",
+			nil,
+		},
+	}
+
+	for _, tc := range cases {
+		text, trailers := parseTrailers(tc.msg)
+		if text != tc.text {
+			t.Errorf("Got text %q, expected %q", text, tc.text)
+		}
+		if !reflect.DeepEqual(trailers, tc.trailers) {
+			t.Errorf("Got trailers %q, expected %q", trailers, tc.trailers)
+		}
+	}
+}
+
+func TestRenderTrailers(t *testing.T) {
+	var ts trailers
+	ts = ts.add("x-custom", "foo")
+	ts = ts.add("LGTM", "a, b")
+	ts = ts.add("signed-off-by", "A <a@example.com>")
+	ts = ts.add("GitHub-Pull-Request", "https://github.com/a/b/pull/1")
+	ts = ts.add("Signed-Off-By", "A <a@example.com>")
+	ts = ts.add("Fixes", "#1")
+	ts = ts.add("Fixes", "#2")
+	ts = ts.add("Fixes", "")
+	ts = ts.add("Change-Id", "I1234")
+	ts = ts.add("CC", "B <b@example.com>")
+	ts = ts.add("cc", "B <b@example.com>")
+
+	expected := `GitHub-Pull-Request: https://github.com/a/b/pull/1
+Fixes: #1
+Fixes: #2
+LGTM: a, b
+Signed-off-by: A <a@example.com>
+x-custom: foo
+Change-Id: I1234
+CC: B <b@example.com>
+`
+	if actual := ts.String(); actual != expected {
+		t.Errorf("Got\n%s\nexpected\n%s", actual, expected)
+	}
+
+	if vals := ts.values("fixes"); !reflect.DeepEqual(vals, []string{"#1", "#2"}) {
+		t.Errorf("Unexpected values %q", vals)
+	}
+	if vals := ts.values("change-id"); !reflect.DeepEqual(vals, []string{"I1234"}) {
+		t.Errorf("Unexpected values %q", vals)
+	}
+	if vals := ts.remove("FIXES").values("fixes"); len(vals) != 0 {
+		t.Errorf("Unexpected values %q after removal", vals)
+	}
+}
+
+func TestWithTrailers(t *testing.T) {
+	msg := "lib: Fix thing\n\nText.\n\nFixes: #1\n"
+	text, ts := parseTrailers(msg)
+	ts = ts.add("GitHub-Pull-Request", "https://github.com/a/b/pull/1")
+	ts = ts.add("Fixes", "#1")
+
+	expected := "lib: Fix thing\n\nText.\n\nGitHub-Pull-Request: https://github.com/a/b/pull/1\nFixes: #1\n"
+	if actual := withTrailers(text, ts); actual != expected {
+		t.Errorf("Got %q, expected %q", actual, expected)
+	}
+}
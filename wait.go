@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultWaitTimeout     = 30 * time.Minute
+	defaultPollInterval    = 5 * time.Second
+	defaultMaxPollInterval = 2 * time.Minute
+	maxCommandTimeout      = 24 * time.Hour // for Timeout: in merge commands
+	pollJitter             = 0.1            // +/- fraction of the poll interval
+)
+
+// The waitConfig controls how long we wait for the build status to turn
+// green, and how often we check it. The interval doubles after each check,
+// up to the maximum.
+//
+//	"wait": {"timeout": "2h", "interval": "10s", "max_interval": "5m"}
+type waitConfig struct {
+	Timeout     duration `json:"timeout"`
+	Interval    duration `json:"interval"`
+	MaxInterval duration `json:"max_interval"`
+}
+
+func (c waitConfig) validate() error {
+	if c.Timeout < 0 || c.Interval < 0 || c.MaxInterval < 0 {
+		return fmt.Errorf("wait: negative duration")
+	}
+	if c.Interval > 0 && c.MaxInterval > 0 && c.MaxInterval < c.Interval {
+		return fmt.Errorf("wait: max_interval is less than interval")
+	}
+	return nil
+}
+
+// duration is a time.Duration given as a string like "90m" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// A waitPolicy is the resolved waitConfig for a merge.
+type waitPolicy struct {
+	timeout     time.Duration
+	interval    time.Duration
+	maxInterval time.Duration
+}
+
+// waitPolicy returns how to wait for the build status of the PR in the
+// comment. A "Timeout:" field in the comment overrides the configured
+// timeout, up to maxCommandTimeout.
+func (h *handler) waitPolicy(ctx context.Context, c comment) waitPolicy {
+	p := waitPolicy{
+		timeout:     defaultWaitTimeout,
+		interval:    defaultPollInterval,
+		maxInterval: defaultMaxPollInterval,
+	}
+	if wc := h.config.repo(c.Repository.FullName).Wait; wc != nil {
+		if wc.Timeout > 0 {
+			p.timeout = time.Duration(wc.Timeout)
+		}
+		if wc.Interval > 0 {
+			p.interval = time.Duration(wc.Interval)
+		}
+		if wc.MaxInterval > 0 {
+			p.maxInterval = time.Duration(wc.MaxInterval)
+		}
+	}
+	if p.maxInterval < p.interval {
+		p.maxInterval = p.interval
+	}
+
+	if vals := fieldValues(c.Comment.Body, "Timeout"); len(vals) > 0 {
+		v := vals[len(vals)-1]
+		timeout, err := time.ParseDuration(v)
+		switch {
+		case err != nil || timeout <= 0:
+			logger(ctx).Warn("Ignoring bad timeout", "timeout", v, "error", err)
+		case timeout > maxCommandTimeout:
+			p.timeout = maxCommandTimeout
+		default:
+			p.timeout = timeout
+		}
+	}
+	return p
+}
+
+// next returns the interval to wait after waiting cur: twice as long, up
+// to the maximum.
+func (p waitPolicy) next(cur time.Duration) time.Duration {
+	next := 2 * cur
+	if next > p.maxInterval {
+		next = p.maxInterval
+	}
+	return next
+}
+
+// jittered returns d adjusted by a random amount of up to pollJitter.
+func jittered(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*pollJitter*float64(d))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWaitPolicy(t *testing.T) {
+	var cfg config
+	err := json.Unmarshal([]byte(`{"repos": {"a/slow": {"wait": {"timeout": "2h", "interval": "10s", "max_interval": "5m"}}}}`), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{permissions: permissions{config: &cfg}}
+
+	cases := []struct {
+		repo string
+		body string
+		exp  waitPolicy
+	}{
+		{"a/b", "@mergebot merge", waitPolicy{defaultWaitTimeout, defaultPollInterval, defaultMaxPollInterval}},
+		{"a/slow", "@mergebot merge", waitPolicy{2 * time.Hour, 10 * time.Second, 5 * time.Minute}},
+		{"a/slow", "@mergebot merge\n\nTimeout: 3h", waitPolicy{3 * time.Hour, 10 * time.Second, 5 * time.Minute}},
+		{"a/b", "@mergebot merge\n\nTimeout: 1w", waitPolicy{defaultWaitTimeout, defaultPollInterval, defaultMaxPollInterval}},
+		{"a/b", "@mergebot merge\n\nTimeout: 100h", waitPolicy{maxCommandTimeout, defaultPollInterval, defaultMaxPollInterval}},
+	}
+	for _, tc := range cases {
+		p := h.waitPolicy(context.Background(), newComment(tc.repo, 1, "jb", tc.body))
+		if p != tc.exp {
+			t.Errorf("%s %q: %+v != %+v", tc.repo, tc.body, p, tc.exp)
+		}
+	}
+}
+
+func TestWaitPolicyBackoff(t *testing.T) {
+	p := waitPolicy{timeout: time.Hour, interval: 5 * time.Second, maxInterval: time.Minute}
+	var waits []time.Duration
+	for w := p.interval; len(waits) < 6; w = p.next(w) {
+		waits = append(waits, w)
+	}
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute}
+	for i := range waits {
+		if waits[i] != expected[i] {
+			t.Fatalf("%v != %v", waits, expected)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if d := jittered(time.Minute); d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("Jittered too much: %v", d)
+		}
+	}
+}
+
+func TestWaitConfigValidate(t *testing.T) {
+	var cfg config
+	if err := json.Unmarshal([]byte(`{"repos": {"*": {"wait": {"timeout": "soon"}}}}`), &cfg); err == nil {
+		t.Error("Unexpected nil error for bad duration")
+	}
+	cfg = config{Repos: map[string]repoConfig{"*": {Wait: &waitConfig{Interval: duration(time.Minute), MaxInterval: duration(time.Second)}}}}
+	if err := cfg.validate(); err == nil {
+		t.Error("Unexpected nil error for max_interval < interval")
+	}
+}
@@ -1,30 +1,51 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"sort"
 	"strings"
+	"sync"
 )
 
-type prHandler func(p pr)
-type commentHandler func(c comment)
+type prHandler func(ctx context.Context, p pr)
+type commentHandler func(ctx context.Context, c comment)
+type membershipHandler func(ctx context.Context, m membership)
+type protectionHandler func(ctx context.Context, pc protectionChange)
 
 // The webhook listens on addr for commands to username and send them to the outbox.
 type webhook struct {
-	addr            string
-	secret          string
-	username        string
-	token           string
-	commentHandlers map[string]commentHandler
-	prHandlers      []prHandler
-	listener        net.Listener
+	addr               string
+	secret             string
+	username           string
+	token              string
+	commentHandlers    map[string]commentHandler
+	prHandlers         []prHandler
+	membershipHandlers []membershipHandler
+	protectionHandlers []protectionHandler
+	readinessChecks    map[string]readinessCheck
+	handlers           map[string]http.Handler
+
+	mut    sync.Mutex
+	server *http.Server
+}
+
+// knownEvents are the event types we handle.
+var knownEvents = map[string]bool{
+	"issue_comment":          true,
+	"pull_request":           true,
+	"member":                 true,
+	"membership":             true,
+	"team":                   true,
+	"branch_protection_rule": true,
+	"repository_ruleset":     true,
 }
 
 func newWebhook(addr, secret, username, token string) *webhook {
@@ -34,6 +55,8 @@ func newWebhook(addr, secret, username, token string) *webhook {
 		username:        username,
 		token:           token,
 		commentHandlers: make(map[string]commentHandler),
+		readinessChecks: make(map[string]readinessCheck),
+		handlers:        make(map[string]http.Handler),
 	}
 }
 
@@ -41,40 +64,92 @@ func (h *webhook) handlePR(fn prHandler) {
 	h.prHandlers = append(h.prHandlers, fn)
 }
 
+func (h *webhook) handleMembership(fn membershipHandler) {
+	h.membershipHandlers = append(h.membershipHandlers, fn)
+}
+
+func (h *webhook) handleProtectionChange(fn protectionHandler) {
+	h.protectionHandlers = append(h.protectionHandlers, fn)
+}
+
 func (h *webhook) handleComment(prefix string, fn commentHandler) {
 	h.commentHandlers[prefix] = fn
 }
 
+// addReadinessCheck adds a check that must pass for /readyz to report
+// that we're ready to receive webhooks.
+func (h *webhook) addReadinessCheck(name string, fn readinessCheck) {
+	h.readinessChecks[name] = fn
+}
+
+// addHandler serves the handler at path, next to the webhook receiver.
+func (h *webhook) addHandler(path string, handler http.Handler) {
+	h.handlers[path] = handler
+}
+
 func (h *webhook) Serve() {
-	s := http.NewServeMux()
-	s.Handle("/", h)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.Handle("/readyz", readinessHandler(h.readinessChecks))
+	for path, handler := range h.handlers {
+		mux.Handle(path, handler)
+	}
+	mux.Handle("/", h)
 
 	l, err := net.Listen("tcp", h.addr)
 	if err != nil {
-		log.Println("Listen:", err)
+		slog.Error("Listen", "error", err)
 		return
 	}
 
-	log.Println("Web hook receiver listening on", l.Addr())
-	h.listener = l
-	http.Serve(l, h)
+	slog.Info("Web hook receiver listening", "addr", l.Addr())
+	srv := &http.Server{Handler: mux}
+	h.mut.Lock()
+	h.server = srv
+	h.mut.Unlock()
+	srv.Serve(l)
 }
 
+// Stop stops accepting webhooks and waits for the ones being handled to
+// finish.
 func (h *webhook) Stop() {
-	h.listener.Close()
+	h.mut.Lock()
+	srv := h.server
+	h.mut.Unlock()
+	if srv != nil {
+		srv.Shutdown(context.Background())
+	}
 }
 
 func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The context carries the logger with fields identifying the delivery,
+	// and later the repository, PR and so on. It is deliberately not
+	// derived from the request context, as handlers may keep running long
+	// after the response to GitHub has been sent.
+	eventType := r.Header.Get("X-Github-Event")
+	ctx := withLogFields(context.Background(), "delivery", r.Header.Get("X-Github-Delivery"), "event", eventType)
+	l := logger(ctx)
+
+	// The event type is only trusted, and used as a metric label, once
+	// the signature checks out.
+	event := "unknown"
+	result := "ok"
+	defer func() {
+		metricWebhookDeliveries.WithLabelValues(event, result).Inc()
+	}()
+
 	// We only expect POST requests here.
 	if r.Method != "POST" {
-		log.Println("Unexpected method", r.Method)
+		result = "bad method"
+		l.Warn("Unexpected method", "method", r.Method)
 		http.Error(w, "POST Expected", http.StatusMethodNotAllowed)
 		return
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println("Reading body:", err)
+		result = "bad request"
+		l.Error("Reading body", "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
@@ -87,29 +162,38 @@ func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// If it doesn't match the included header, return 401 Unauthorized
 	// and abort.
 	if hubSig := r.Header.Get("X-Hub-Signature"); hubSig != sig {
-		log.Printf("Incorrect signature; %s != %s", hubSig, sig)
+		result = "bad signature"
+		metricSignatureFailures.Inc()
+		l.Warn("Incorrect signature", "got", hubSig, "expected", sig)
 		http.Error(w, "Incorrect Secret", http.StatusUnauthorized)
 		return
 	}
 
-	switch eventType := r.Header.Get("X-Github-Event"); eventType {
+	if knownEvents[eventType] {
+		event = eventType
+	}
+
+	switch eventType {
 	case "issue_comment":
 		var c comment
 		if err := json.Unmarshal(body, &c); err != nil {
-			log.Println("Unmarshal:", err)
-			log.Println(string(body))
+			result = "bad request"
+			l.Error("Unmarshal", "error", err, "body", string(body))
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		ctx = withLogFields(ctx, "repo", c.Repository.FullName, "pr", c.Issue.Number, "sender", c.Sender.Login)
+		l = logger(ctx)
+
 		body := c.parseBody()
 		if body.recipient == h.username {
-			log.Printf("Handling comment by %s on %s", c.Sender.Login, c.Repository.FullName)
 			body.command = strings.ToLower(body.command)
+			l.Info("Handling comment", "command", body.command)
 			handled := false
 			for prefix, fn := range h.commentHandlers {
 				if strings.HasPrefix(body.command, prefix) {
-					fn(c)
+					fn(withLogFields(ctx, "command", prefix), c)
 					handled = true
 				}
 			}
@@ -122,27 +206,61 @@ func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				knownCommands := strings.Join(prefixes, ", ")
 
 				msg := fmt.Sprintf("I'm sorry, @%s. I'm afraid I don't know what you mean. I know how to %s.", c.Sender.Login, knownCommands)
-				c.post(msg, h.username, h.token)
+				c.post(ctx, msg, h.username, h.token)
 			}
 		} else {
-			log.Printf("Ignoring comment by %s on %s that does not look like it's for us", c.Sender.Login, c.Repository.FullName)
+			l.Debug("Ignoring comment that does not look like it's for us")
 		}
 
 	case "pull_request":
 		var p pr
 		if err := json.Unmarshal(body, &p); err != nil {
-			log.Println("Unmarshal:", err)
-			log.Println(string(body))
+			result = "bad request"
+			l.Error("Unmarshal", "error", err, "body", string(body))
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		log.Printf("Handling pull request %d", p.Number)
+		ctx = withLogFields(ctx, "repo", p.Repository.FullName, "pr", p.Number, "action", p.Action)
+		logger(ctx).Info("Handling pull request")
 		for _, fn := range h.prHandlers {
-			fn(p)
+			fn(ctx, p)
+		}
+
+	case "member", "membership", "team":
+		var m membership
+		if err := json.Unmarshal(body, &m); err != nil {
+			result = "bad request"
+			l.Error("Unmarshal", "error", err, "body", string(body))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Event = eventType
+
+		ctx = withLogFields(ctx, "action", m.Action)
+		logger(ctx).Info("Handling membership change")
+		for _, fn := range h.membershipHandlers {
+			fn(ctx, m)
+		}
+
+	case "branch_protection_rule", "repository_ruleset":
+		var pc protectionChange
+		if err := json.Unmarshal(body, &pc); err != nil {
+			result = "bad request"
+			l.Error("Unmarshal", "error", err, "body", string(body))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pc.Event = eventType
+
+		ctx = withLogFields(ctx, "action", pc.Action)
+		logger(ctx).Info("Handling branch protection change")
+		for _, fn := range h.protectionHandlers {
+			fn(ctx, pc)
 		}
 
 	default:
-		log.Printf("Unknown event type %q, ignored", eventType)
+		result = "ignored"
+		l.Debug("Unknown event type, ignored")
 	}
 }